@@ -0,0 +1,218 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+)
+
+// apiKeyContextKey is the gin context key of the openai.APIKey of a request
+const apiKeyContextKey = "api_key"
+
+// abortFunc aborts a request with an error in the format of its endpoint
+type abortFunc func(c *gin.Context, code int, msg string)
+
+func abortJSON(c *gin.Context, code int, msg string) {
+	c.AbortWithStatusJSON(code, newErrorResponse(code, msg))
+}
+
+// authenticate authenticates "Authorization: Bearer <key>" with Keys and puts the principal of
+// the key in the request context
+func authenticate(abort abortFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key := strings.TrimSpace(strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer "))
+		if key == "" {
+			abort(c, http.StatusUnauthorized, "no api key provided, use the Authorization: Bearer <key> header")
+			return
+		}
+		k, err := Keys.AuthenticateAPIKey(c.Request.Context(), key)
+		switch {
+		case errors.Is(err, openai.ErrInvalidAPIKey):
+			abort(c, http.StatusUnauthorized, err.Error())
+			return
+		case err != nil:
+			abort(c, http.StatusInternalServerError, err.Error())
+			return
+		}
+		c.Set(apiKeyContextKey, k)
+		c.Request = c.Request.WithContext(openai.WithPrincipal(c.Request.Context(), k.Principal()))
+		c.Next()
+	}
+}
+
+// requireScope aborts requests whose api key lacks scope with 403
+func requireScope(scope string, abort abortFunc) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !requestKey(c).HasScope(scope) {
+			abort(c, http.StatusForbidden, "the api key lacks the "+scope+" scope")
+			return
+		}
+		c.Next()
+	}
+}
+
+// requestKey returns the api key of an authenticated request
+func requestKey(c *gin.Context) openai.APIKey {
+	k, _ := c.Get(apiKeyContextKey)
+	key, _ := k.(openai.APIKey)
+	return key
+}
+
+// CreateAPIKeyRequest creates an api key
+type CreateAPIKeyRequest struct {
+	Name string `json:"name" example:"laptop"`
+	// Owner defaults to the owner of the calling key, only admins create keys of other owners
+	Owner string `json:"owner,omitempty"`
+	// Scopes default to the scopes of the calling key, they can not exceed them
+	Scopes []string `json:"scopes,omitempty" example:"read,chat"`
+}
+
+// CreateAPIKeyResponse is the created api key, the key itself is only shown here
+type CreateAPIKeyResponse struct {
+	openai.APIKey
+	Key string `json:"key" example:"alone-..."`
+}
+
+// ListAPIKeys doc
+//
+//	@Router			/api_keys [get]
+//	@Summary		List api keys
+//	@Description	List the api keys of the owner of the calling key, admins see the keys of all owners
+//	@Tags			api_key
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			offset	query		int		false	"Offset"
+//	@Param			limit	query		int		false	"Page size"											default(20)	maximum(100)
+//	@Param			sort	query		string	false	"Sort column, prefix with - for descending order"	default(id)
+//	@Param			owner	query		string	false	"Owner"
+//	@Param			revoked	query		bool	false	"Include revoked keys"
+//	@Success		200		{object}	Page{items=[]openai.APIKey}
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+func ListAPIKeys(c *gin.Context) {
+	opts, err := listOptions(c)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	keys, total, err := Keys.ListAPIKeys(c.Request.Context(), openai.APIKeyFilter{
+		ListOptions: opts,
+		Owner:       c.Query("owner"),
+		Revoked:     c.Query("revoked") == "true",
+	})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newPage(c, keys, total, opts))
+}
+
+// GetAPIKey doc
+//
+//	@Router			/api_keys/{id} [get]
+//	@Summary		Get api key
+//	@Description	Get an api key of the owner of the calling key, admins get keys of all owners
+//	@Tags			api_key
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			id	path		int	true	"API key ID"
+//	@Success		200	{object}	openai.APIKey
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		401	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
+func GetAPIKey(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	k, err := Keys.GetAPIKey(c.Request.Context(), uint(id))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, k)
+}
+
+// CreateAPIKey doc
+//
+//	@Router			/api_keys [post]
+//	@Summary		Create api key
+//	@Description	Create an api key with at most the scopes of the calling key, scopes are "read", "chat" and "admin". The key is only returned by this request.
+//	@Tags			api_key
+//	@Accept			json
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			body	body		CreateAPIKeyRequest	true	"API key"
+//	@Success		201		{object}	CreateAPIKeyResponse
+//	@Header			201		{string}	Location	"/api_keys/1"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		403		{object}	ErrorResponse
+//	@Failure		422		{object}	ErrorResponse	"invalid scope"
+//	@Failure		500		{object}	ErrorResponse
+func CreateAPIKey(c *gin.Context) {
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	caller := requestKey(c)
+	k := openai.APIKey{Name: req.Name, Owner: req.Owner, Scopes: req.Scopes}
+	if k.Owner == "" {
+		k.Owner = caller.Owner
+	}
+	if len(k.Scopes) == 0 {
+		k.Scopes = caller.Scopes
+	}
+	if k.Owner != caller.Owner && !caller.HasScope(openai.ScopeAdmin) {
+		errorJSON(c, http.StatusForbidden, "only admins create keys of other owners")
+		return
+	}
+	for _, scope := range k.Scopes {
+		if !caller.HasScope(scope) {
+			errorJSON(c, http.StatusForbidden, "the api key lacks the "+scope+" scope")
+			return
+		}
+	}
+	key, err := Keys.CreateAPIKey(c.Request.Context(), &k)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	created(c, fmt.Sprintf("/api_keys/%d", k.ID), CreateAPIKeyResponse{APIKey: k, Key: key})
+}
+
+// RevokeAPIKey doc
+//
+//	@Router			/api_keys/{id} [delete]
+//	@Summary		Revoke api key
+//	@Description	Revoke an api key of the owner of the calling key, admins revoke keys of all owners
+//	@Tags			api_key
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Param			id	path	int	true	"API key ID"
+//	@Success		204
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		401	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
+func RevokeAPIKey(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil || id == 0 {
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	if err := Keys.RevokeAPIKey(c.Request.Context(), uint(id)); err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// SendMessageRequest is a user message sent to the model
+type SendMessageRequest struct {
+	Content string `json:"content" binding:"required" example:"Hello"`
+	// Stream answers with server-sent events, also selected by "Accept: text/event-stream"
+	Stream bool `json:"stream"`
+	// Locale and Fields are template variables of the system role
+	Locale string            `json:"locale,omitempty"`
+	Fields map[string]string `json:"fields,omitempty"`
+}
+
+// NewConversationMessageRequest starts a conversation with a user message
+type NewConversationMessageRequest struct {
+	SendMessageRequest
+	// Name defaults to a random name
+	Name         string                  `json:"name,omitempty"`
+	SystemRoleID uint                    `json:"system_role_id,omitempty"`
+	Sampling     openai.SamplingSettings `json:"sampling,omitempty"`
+}
+
+// Usage is the token usage and the cost of an answer
+type Usage struct {
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	TotalTokens      int     `json:"total_tokens"`
+	CostUSD          float64 `json:"cost_usd"`
+}
+
+// SendMessageResponse is the answer of the model. In stream mode it is the data of the final
+// "message" event.
+type SendMessageResponse struct {
+	Message openai.ChatCompletionMessage `json:"message"`
+	Usage   Usage                        `json:"usage"`
+}
+
+// MessageWithCost is a message with the cost of its completion call
+type MessageWithCost struct {
+	openai.ChatCompletionMessage
+	CostUSD float64 `json:"cost_usd"`
+}
+
+// StreamDelta is the data of a "delta" event, a piece of the answer
+type StreamDelta struct {
+	Content string `json:"content"`
+}
+
+// SendMessage doc
+//
+//	@Router			/conversations/{conversation_id}/messages [post]
+//	@Summary		Send message
+//	@Description	Send a user message to the model and return the answer with its usage. In stream mode the answer is sent as server-sent events: "delta" events with pieces of the answer, then a "message" event with the SendMessageResponse, or an "error" event.
+//	@Tags			message
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json,text/event-stream
+//	@Param			conversation_id	path		int					true	"Conversation ID"
+//	@Param			body			body		SendMessageRequest	true	"Message"
+//	@Success		200				{object}	SendMessageResponse
+//	@Failure		400				{object}	ErrorResponse
+//	@Failure		404				{object}	ErrorResponse
+//	@Failure		422				{object}	ErrorResponse	"rejected by moderation or message too long"
+//	@Failure		429				{object}	ErrorResponse	"rate limited by OpenAI"
+//	@Failure		500				{object}	ErrorResponse
+//	@Failure		502				{object}	ErrorResponse	"OpenAI request failed"
+func SendMessage(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("conversation_id"), 10, 64)
+	if err != nil || id == 0 {
+		errorJSON(c, http.StatusBadRequest, "conversation_id is invalid")
+		return
+	}
+	var req SendMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	send(c, uint(id), req, "")
+}
+
+// SendNewConversationMessage doc
+//
+//	@Router			/conversations/messages [post]
+//	@Summary		Start conversation
+//	@Description	Create a conversation and send its first user message like POST /conversations/{conversation_id}/messages. The Location header is the created conversation, also in stream mode.
+//	@Tags			message
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json,text/event-stream
+//	@Param			body	body		NewConversationMessageRequest	true	"Conversation and message"
+//	@Success		201		{object}	SendMessageResponse
+//	@Header			201		{string}	Location	"/conversations/1"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse	"system role not found"
+//	@Failure		422		{object}	ErrorResponse	"invalid sampling, rejected by moderation or message too long"
+//	@Failure		429		{object}	ErrorResponse	"rate limited by OpenAI"
+//	@Failure		500		{object}	ErrorResponse
+//	@Failure		502		{object}	ErrorResponse	"OpenAI request failed"
+func SendNewConversationMessage(c *gin.Context) {
+	var req NewConversationMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	conv, err := startConversation(c.Request.Context(), req)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	send(c, conv.ID, req.SendMessageRequest, fmt.Sprintf("/conversations/%d", conv.ID))
+}
+
+// startConversation creates the conversation of the first message req
+func startConversation(ctx context.Context, req NewConversationMessageRequest) (openai.Conversation, error) {
+	conv := openai.Conversation{
+		Name:         req.Name,
+		SystemRoleID: req.SystemRoleID,
+		Sampling:     req.Sampling,
+	}
+	if err := checkModel(req.Sampling); err != nil {
+		return conv, err
+	}
+	if conv.Name == "" {
+		conv.Name = uuid.NewString()
+	}
+	err := Backend.AddConversation(ctx, &conv)
+	return conv, err
+}
+
+// send sends req to conversation id and writes the answer as json or as server-sent events,
+// location is the location of a conversation created for req
+func send(c *gin.Context, id uint, req SendMessageRequest, location string) {
+	ctx := sendContext(c.Request.Context(), req)
+	if !req.Stream && !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		msg, err := Backend.Send(ctx, id, req.Content)
+		if err != nil {
+			sendError(c, msg, err)
+			return
+		}
+		if location != "" {
+			created(c, location, newSendMessageResponse(msg))
+			return
+		}
+		c.JSON(http.StatusOK, newSendMessageResponse(msg))
+		return
+	}
+	// errors before the first piece are answered with a status code, later ones as events
+	started := false
+	start := func() {
+		started = true
+		if location != "" {
+			c.Header("Location", location)
+		}
+		startStream(c)
+	}
+	msg, err := Backend.SendStream(ctx, id, req.Content, func(delta string) error {
+		if !started {
+			start()
+		}
+		c.SSEvent("delta", StreamDelta{Content: delta})
+		c.Writer.Flush()
+		return c.Request.Context().Err()
+	})
+	if !started {
+		if err != nil {
+			sendError(c, msg, err)
+			return
+		}
+		start()
+	}
+	if err != nil {
+		_, body := sendErrorResponse(msg, err)
+		c.SSEvent("error", body)
+	} else {
+		c.SSEvent("message", newSendMessageResponse(msg))
+	}
+	c.Writer.Flush()
+}
+
+// sendContext returns ctx carrying the template variables of req
+func sendContext(ctx context.Context, req SendMessageRequest) context.Context {
+	p, _ := openai.PrincipalFrom(ctx)
+	return openai.WithTemplateVars(ctx, openai.TemplateVars{
+		Username: p.Owner,
+		Locale:   req.Locale,
+		Fields:   req.Fields,
+	})
+}
+
+func startStream(c *gin.Context) {
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// keep reverse proxies from buffering the events
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+}
+
+// sendError answers with the error of Send, msg is the failed answer
+func sendError(c *gin.Context, msg openai.ChatCompletionMessage, err error) {
+	code, body := sendErrorResponse(msg, err)
+	c.JSON(code, body)
+}
+
+// sendErrorResponse maps an error of Send like errorResponse, failed OpenAI calls are 502 with
+// the failed answer
+func sendErrorResponse(msg openai.ChatCompletionMessage, err error) (int, ErrorResponse) {
+	code, body := errorResponse(err)
+	if code == http.StatusInternalServerError && msg.Status == openai.MessageStatusError {
+		code, body = http.StatusBadGateway, newErrorResponse(http.StatusBadGateway, err.Error())
+		body.Error.Answer = &msg
+	}
+	return code, body
+}
+
+// checkModel rejects sampling settings with a model that is not in Models
+func checkModel(s openai.SamplingSettings) error {
+	if s.Model == "" || knownModel(s.Model) {
+		return nil
+	}
+	return fmt.Errorf("%w: model %q is not offered, see GET /v1/models", openai.ErrInvalidSampling, s.Model)
+}
+
+func newSendMessageResponse(msg openai.ChatCompletionMessage) SendMessageResponse {
+	return SendMessageResponse{
+		Message: msg,
+		Usage: Usage{
+			PromptTokens:     msg.PromptTokens,
+			CompletionTokens: msg.CompletionTokens,
+			TotalTokens:      msg.PromptTokens + msg.CompletionTokens,
+			CostUSD:          openai.Cost(msg),
+		},
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"time"
+
+	"github.com/coolbit-in/alone/config"
+	"github.com/coolbit-in/alone/openai"
+	"github.com/coolbit-in/alone/storage"
+	gogpt "github.com/sashabaranov/go-openai"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Config is the configuration of the api server, it is read from the file of --conf, see
+// config.yaml.example. Flags override the values of the file.
+type Config struct {
+	// SqlitePath is the sqlite file, it is used when Database is not configured
+	SqlitePath string         `mapstructure:"sqlite_path,omitempty"`
+	Database   storage.Config `mapstructure:"database,omitempty"`
+	// EncryptionKeyFile enables encryption of message and system role content
+	EncryptionKeyFile string           `mapstructure:"encryption_key_file,omitempty"`
+	OpenaiToken       string           `mapstructure:"openai_token"`
+	Redaction         config.Redaction `mapstructure:"redaction,omitempty"`
+	// ResponseCacheTTL enables the response cache of context-free prompts, e.g. "24h"
+	ResponseCacheTTL time.Duration        `mapstructure:"response_cache_ttl,omitempty"`
+	SemanticCache    config.SemanticCache `mapstructure:"semantic_cache,omitempty"`
+	Log              config.Log           `mapstructure:"log,omitempty"`
+	Readiness        config.Readiness     `mapstructure:"readiness,omitempty"`
+	Server           config.Server        `mapstructure:"server,omitempty"`
+	// V1Models are the models of the OpenAI compatible /v1 endpoints
+	V1Models []string `mapstructure:"v1_models,omitempty"`
+	// V1Moderation moderates the messages of /v1/chat/completions like the moderation policy of
+	// a system role moderates the messages of its conversations
+	V1Moderation openai.ModerationPolicy `mapstructure:"v1_moderation,omitempty"`
+	// EventPollInterval is how often added messages are polled for the events of /ws, 0
+	// disables the events
+	EventPollInterval time.Duration `mapstructure:"event_poll_interval,omitempty"`
+}
+
+// flagKeys are the config keys set by flags
+var flagKeys = map[string]string{
+	"dbpath":                   "sqlite_path",
+	"openai-token":             "openai_token",
+	"encryption-key-file":      "encryption_key_file",
+	"redact":                   "redaction.enabled",
+	"response-cache-ttl":       "response_cache_ttl",
+	"semantic-cache-ttl":       "semantic_cache.ttl",
+	"semantic-cache-threshold": "semantic_cache.threshold",
+	"embedder":                 "semantic_cache.embedder",
+	"log-level":                "log.level",
+	"log-content":              "log.content",
+	"readyz-openai":            "readiness.openai",
+	"readyz-openai-ttl":        "readiness.openai_ttl",
+	"v1-models":                "v1_models",
+	"address":                  "server.address",
+	"tls":                      "server.tls.enabled",
+	"tls-cert":                 "server.tls.cert_file",
+	"tls-key":                  "server.tls.key_file",
+	"tls-min-version":          "server.tls.min_version",
+	"event-poll-interval":      "event_poll_interval",
+}
+
+// defineFlags defines the flags of flagKeys, their defaults are the defaults of the config
+func defineFlags() {
+	pflag.StringP("dbpath", "p", "chat.db", "database path")
+	pflag.StringP("openai-token", "t", "", "openai token")
+	pflag.String("encryption-key-file", "", "encryption key file of message and system role content")
+	pflag.Bool("redact", false, "redact secrets, emails, phone numbers and IPs before prompts are sent to OpenAI")
+	pflag.Duration("response-cache-ttl", 0, "answer context-free prompts from cache for this long, 0 disables the cache")
+	pflag.Duration("semantic-cache-ttl", 0, "answer context-free prompts with answers of similar prompts for this long, 0 disables the semantic cache")
+	pflag.Float32("semantic-cache-threshold", 0.95, "minimum similarity of semantic cache hits for system roles without threshold")
+	pflag.String("embedder", "openai", "embedder of the semantic cache, openai or hash")
+	pflag.String("log-level", "info", "log level: debug, info, warn or error, PUT /admin/log_level changes it at runtime")
+	pflag.String("log-content", "omit", "how message content is logged: omit, redact or full")
+	pflag.Bool("readyz-openai", true, "check OpenAI reachability in /readyz")
+	pflag.Duration("readyz-openai-ttl", time.Minute, "reuse the result of the OpenAI check of /readyz for this long")
+	pflag.StringSlice("v1-models", []string{gogpt.GPT3Dot5Turbo, gogpt.GPT3Dot5Turbo0301}, "models of the OpenAI compatible /v1 endpoints")
+	pflag.String("address", "", `listen address, default ":443" with TLS and ":8080" without`)
+	pflag.Bool("tls", true, "serve HTTPS, disable for plain HTTP behind a TLS terminating reverse proxy")
+	pflag.String("tls-cert", "cert.pem", "TLS certificate file, reloaded when it changes")
+	pflag.String("tls-key", "key.pem", "TLS key file, reloaded when it changes")
+	pflag.String("tls-min-version", "1.2", "minimum TLS version: 1.0, 1.1, 1.2 or 1.3")
+	pflag.Duration("event-poll-interval", 2*time.Second, "poll added messages for the events of /ws this often, 0 disables the events")
+}
+
+// initConfig reads the config file at path, empty for none, and applies the flags
+func initConfig(path string) (Config, error) {
+	var conf Config
+	if err := config.Read(path); err != nil {
+		return conf, err
+	}
+	for flag, key := range flagKeys {
+		if err := viper.BindPFlag(key, pflag.Lookup(flag)); err != nil {
+			return conf, err
+		}
+	}
+	if err := viper.Unmarshal(&conf); err != nil {
+		return conf, err
+	}
+	if conf.Database.Driver == "" && conf.Database.DSN == "" {
+		conf.Database = storage.Config{Driver: storage.DriverSqlite, DSN: conf.SqlitePath}
+	}
+	if conf.SemanticCache.Embedder == "" {
+		conf.SemanticCache.Embedder = "openai"
+	}
+	if conf.SemanticCache.Threshold == 0 {
+		conf.SemanticCache.Threshold = 0.95
+	}
+	return conf, nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+)
+
+// ErrorResponse is the body of the error responses of the REST endpoints
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+// ErrorDetail describes an error, clients act on Code, Message is for humans
+type ErrorDetail struct {
+	Code    string `json:"code" example:"not_found"`
+	Message string `json:"message" example:"conversation 1 not found"`
+	// Reasons are the moderation categories of a content_policy_violation
+	Reasons []string `json:"reasons,omitempty"`
+	// Answer is the failed answer of an upstream_error, it is kept in the conversation
+	Answer *openai.ChatCompletionMessage `json:"answer,omitempty"`
+}
+
+// error codes of ErrorDetail
+const (
+	codeInvalidRequest = "invalid_request"
+	codeUnauthorized   = "unauthorized"
+	codeForbidden      = "forbidden"
+	codeNotFound       = "not_found"
+	codeConflict       = "conflict"
+	codeValidation     = "validation_failed"
+	codeContentPolicy  = "content_policy_violation"
+	codeRateLimited    = "rate_limited"
+	codeCanceled       = "canceled"
+	codeInternal       = "internal_error"
+	codeUpstream       = "upstream_error"
+)
+
+// statusCodes are the error codes of the status codes
+var statusCodes = map[int]string{
+	http.StatusBadRequest:          codeInvalidRequest,
+	http.StatusUnauthorized:        codeUnauthorized,
+	http.StatusForbidden:           codeForbidden,
+	http.StatusNotFound:            codeNotFound,
+	http.StatusConflict:            codeConflict,
+	http.StatusUnprocessableEntity: codeValidation,
+	http.StatusTooManyRequests:     codeRateLimited,
+	499:                            codeCanceled,
+	http.StatusBadGateway:          codeUpstream,
+}
+
+// newErrorResponse returns the body of an error answered with status code
+func newErrorResponse(code int, msg string) ErrorResponse {
+	errCode, ok := statusCodes[code]
+	if !ok {
+		errCode = codeInternal
+	}
+	return ErrorResponse{Error: ErrorDetail{Code: errCode, Message: msg}}
+}
+
+// errorJSON answers with status code and the error msg
+func errorJSON(c *gin.Context, code int, msg string) {
+	c.JSON(code, newErrorResponse(code, msg))
+}
+
+// writeError answers with the status code and the body of err, see errorResponse
+func writeError(c *gin.Context, err error) {
+	code, body := errorResponse(err)
+	c.JSON(code, body)
+}
+
+// errorResponse maps an error of the backend to a status code and an error body: missing
+// resources are 404, outdated changes 409, rejected values and content 422 and rate limits of
+// OpenAI 429
+func errorResponse(err error) (int, ErrorResponse) {
+	var policyErr *openai.PolicyError
+	var rateErr *openai.RateLimitError
+	code := http.StatusInternalServerError
+	switch {
+	case errors.As(err, &policyErr):
+		body := newErrorResponse(http.StatusUnprocessableEntity, policyErr.Notice)
+		body.Error.Code, body.Error.Reasons = codeContentPolicy, policyErr.Reasons
+		return http.StatusUnprocessableEntity, body
+	case errors.Is(err, openai.ErrNotFound):
+		code = http.StatusNotFound
+	case errors.Is(err, openai.ErrConflict):
+		code = http.StatusConflict
+	case errors.Is(err, openai.ErrInvalidSampling),
+		errors.Is(err, openai.ErrInvalidSystemRole),
+		errors.Is(err, openai.ErrInvalidScope),
+		errors.Is(err, openai.ErrPromptTooLong):
+		code = http.StatusUnprocessableEntity
+	case errors.Is(err, openai.ErrInvalidListOptions):
+		code = http.StatusBadRequest
+	case errors.As(err, &rateErr):
+		code = http.StatusTooManyRequests
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the answer
+		code = 499
+	}
+	return code, newErrorResponse(code, err.Error())
+}
@@ -2,31 +2,54 @@ package main
 
 import (
 	"context"
-	"crypto/tls"
-	"log"
+	"errors"
+	"fmt"
+	"io"
+	stdlog "log"
 	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	_ "github.com/coolbit-in/alone/api/docs"
+	"github.com/coolbit-in/alone/config"
+	"github.com/coolbit-in/alone/encryption"
+	"github.com/coolbit-in/alone/health"
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/metrics"
 	"github.com/coolbit-in/alone/openai"
+	"github.com/coolbit-in/alone/storage"
+	"github.com/coolbit-in/alone/storage/migrations"
 	"github.com/gin-gonic/gin"
 	"github.com/spf13/pflag"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
 var Backend openai.GptBackend
 
+// Cache is the response cache of Backend, nil when it is disabled
+var Cache openai.ResponseCache
+
+// CacheStats reports the lookups of the response caches of Backend
+var CacheStats func() []openai.CacheStats
+
+// Readiness checks the database and OpenAI for /readyz
+var Readiness = health.New()
+
 //	@title			Phantom Horse API
 //	@version		v1.0
 //	@description	This is a sample server celler server.
 
+//	@securityDefinitions.apikey	ApiKeyAuth
+//	@in							header
+//	@name						Authorization
+//	@description				"Bearer <key>", the first admin key is created with "api apikey create <owner> [name] --scopes admin"
+
 // create http api server use gin, and use gogpt as backend
 
 // GetConversation doc
@@ -35,78 +58,290 @@ var Backend openai.GptBackend
 //	@Summary		Get conversation
 //	@Description	Get conversation
 //	@Tags			conversation
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
 //	@Param			id	path		int	true	"Conversation ID"
 //	@Success		200	{object}	openai.Conversation
-//	@Failure		400	{object}	error
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
 func GetConversation(c *gin.Context) {
 	// bind path param: conversation_id
 	convID := c.Param("conversation_id")
 	if convID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "conversation_id is required"})
+		errorJSON(c, http.StatusBadRequest, "conversation_id is required")
 		return
 	}
 	//convert string to uint
 	convIDUint, err := strconv.ParseUint(convID, 10, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "conversation_id is invalid"})
+		errorJSON(c, http.StatusBadRequest, "conversation_id is invalid")
 		return
 	}
-	conv, err := Backend.GetConversation(uint(convIDUint))
+	conv, err := Backend.GetConversation(c.Request.Context(), uint(convIDUint))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, conv)
 }
 
+// Page is a page of a list endpoint
+type Page struct {
+	Items  interface{} `json:"items"`
+	Total  int64       `json:"total"`
+	Offset int         `json:"offset"`
+	Limit  int         `json:"limit"`
+	// Next is the link to the next page, empty on the last page
+	Next string `json:"next,omitempty"`
+}
+
+// listOptions binds offset, limit and sort query params
+func listOptions(c *gin.Context) (openai.ListOptions, error) {
+	var opts openai.ListOptions
+	var err error
+	if v := c.Query("offset"); v != "" {
+		if opts.Offset, err = strconv.Atoi(v); err != nil || opts.Offset < 0 {
+			return opts, fmt.Errorf("offset is invalid")
+		}
+	}
+	if v := c.Query("limit"); v != "" {
+		if opts.Limit, err = strconv.Atoi(v); err != nil || opts.Limit < 0 {
+			return opts, fmt.Errorf("limit is invalid")
+		}
+	}
+	if opts.Limit == 0 {
+		opts.Limit = openai.DefaultListLimit
+	}
+	if opts.Limit > openai.MaxListLimit {
+		opts.Limit = openai.MaxListLimit
+	}
+	opts.Sort = c.Query("sort")
+	return opts, nil
+}
+
+// newPage wraps items and sets the link of the next page, keeping all other query params
+func newPage(c *gin.Context, items interface{}, total int64, opts openai.ListOptions) Page {
+	page := Page{Items: items, Total: total, Offset: opts.Offset, Limit: opts.Limit}
+	if next := opts.Offset + opts.Limit; int64(next) < total {
+		q := c.Request.URL.Query()
+		q.Set("offset", strconv.Itoa(next))
+		q.Set("limit", strconv.Itoa(opts.Limit))
+		page.Next = c.Request.URL.Path + "?" + q.Encode()
+	}
+	return page
+}
+
+// created answers 201 with the created resource and its location
+func created(c *gin.Context, location string, resource interface{}) {
+	c.Header("Location", location)
+	c.JSON(http.StatusCreated, resource)
+}
+
+// timeQuery parses a RFC3339 query param, it returns zero time if the param is absent
+func timeQuery(c *gin.Context, key string) (time.Time, error) {
+	v := c.Query(key)
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return t, fmt.Errorf("%s is invalid, expect RFC3339 time", key)
+	}
+	return t, nil
+}
+
 // ListConversations doc
 //
 //	@Router			/conversations [get]
 //	@Summary		List conversations
 //	@Description	List conversations
 //	@Tags			conversation
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{array}		openai.Conversation
-//	@Failure		500	{object}	string
-//	@Failure		400	{object}	string
+//	@Param			offset			query		int		false	"Offset"
+//	@Param			limit			query		int		false	"Page size"											default(20)	maximum(100)
+//	@Param			sort			query		string	false	"Sort column, prefix with - for descending order"	default(id)
+//	@Param			owner			query		string	false	"Owner"
+//	@Param			name			query		string	false	"Name contains"
+//	@Param			system_role_id	query		int		false	"System Role ID"
+//	@Param			created_after	query		string	false	"Created at or after, RFC3339"
+//	@Param			created_before	query		string	false	"Created before, RFC3339"
+//	@Success		200				{object}	Page{items=[]openai.Conversation}
+//	@Failure		500				{object}	ErrorResponse
+//	@Failure		400				{object}	ErrorResponse
 func ListConversations(c *gin.Context) {
+	opts, err := listOptions(c)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter := openai.ConversationFilter{
+		ListOptions:  opts,
+		Owner:        c.Query("owner"),
+		NameContains: c.Query("name"),
+	}
+	if v := c.Query("system_role_id"); v != "" {
+		roleID, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			errorJSON(c, http.StatusBadRequest, "system_role_id is invalid")
+			return
+		}
+		filter.SystemRoleID = uint(roleID)
+	}
+	if filter.CreatedAfter, err = timeQuery(c, "created_after"); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if filter.CreatedBefore, err = timeQuery(c, "created_before"); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
 	// call backend
-	convs, err := Backend.ListConversations(nil, nil)
+	convs, total, err := Backend.ListConversations(c.Request.Context(), filter)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newPage(c, convs, total, opts))
+}
+
+// ListMessages doc
+//
+//	@Router			/conversations/{conversation_id}/messages [get]
+//	@Summary		List messages of a conversation
+//	@Description	List messages of a conversation
+//	@Tags			conversation
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			conversation_id	path		int		true	"Conversation ID"
+//	@Param			offset			query		int		false	"Offset"
+//	@Param			limit			query		int		false	"Page size"											default(20)	maximum(100)
+//	@Param			sort			query		string	false	"Sort column, prefix with - for descending order"	default(id)
+//	@Param			role			query		string	false	"Message role"
+//	@Success		200				{object}	Page{items=[]MessageWithCost}
+//	@Failure		500				{object}	ErrorResponse
+//	@Failure		400				{object}	ErrorResponse
+//	@Failure		404				{object}	ErrorResponse	"conversation not found"
+func ListMessages(c *gin.Context) {
+	convIDUint, err := strconv.ParseUint(c.Param("conversation_id"), 10, 64)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, "conversation_id is invalid")
+		return
+	}
+	opts, err := listOptions(c)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		errorJSON(c, http.StatusBadRequest, err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, convs)
+	// an empty page would not tell a missing conversation from one without messages
+	ctx := c.Request.Context()
+	_, n, err := Backend.ListConversations(ctx, openai.ConversationFilter{
+		ListOptions: openai.ListOptions{Limit: 1},
+		IDs:         []uint{uint(convIDUint)},
+	})
+	if err == nil && n == 0 {
+		err = &openai.NotFoundError{Resource: "conversation", ID: c.Param("conversation_id")}
+	}
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	msgs, total, err := Backend.ListMessages(ctx, openai.MessageFilter{
+		ListOptions:    opts,
+		ConversationID: uint(convIDUint),
+		Role:           c.Query("role"),
+	})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	items := make([]MessageWithCost, len(msgs))
+	for i, msg := range msgs {
+		items[i] = MessageWithCost{ChatCompletionMessage: msg, CostUSD: openai.Cost(msg)}
+	}
+	c.JSON(http.StatusOK, newPage(c, items, total, opts))
 }
 
 // AddConversation doc
 //
 //	@Router			/conversations [post]
 //	@Summary		Add conversation
-//	@Description	Add conversation
+//	@Description	Add conversation, its messages are added with POST /messages
 //	@Tags			conversation
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
 //	@Param			body	body		openai.Conversation	true	"Conversation"
-//	@Success		200		{object}	string
-//	@Failure		500		{object}	string
+//	@Success		201		{object}	openai.Conversation
+//	@Header			201		{string}	Location	"/conversations/1"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse	"system role not found"
+//	@Failure		422		{object}	ErrorResponse	"invalid sampling or messages set"
+//	@Failure		500		{object}	ErrorResponse
 func AddConversation(c *gin.Context) {
 	// bind json body
 	var conv openai.Conversation
 	if err := c.ShouldBindJSON(&conv); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	// messages are encrypted by AddMessages only
+	if len(conv.Messages) > 0 {
+		errorJSON(c, http.StatusUnprocessableEntity, "messages can not be set, add them with POST /messages")
+		return
+	}
+	if err := checkModel(conv.Sampling); err != nil {
+		writeError(c, err)
 		return
 	}
 	// call backend
-	err := Backend.AddConversation(&conv)
+	if err := Backend.AddConversation(c.Request.Context(), &conv); err != nil {
+		writeError(c, err)
+		return
+	}
+	created(c, fmt.Sprintf("/conversations/%d", conv.ID), conv)
+}
+
+// SetConversationSampling doc
+//
+//	@Router			/conversations/{conversation_id}/sampling [put]
+//	@Summary		Set conversation sampling
+//	@Description	Replace the sampling overrides of a conversation, unset parameters use the defaults of the system role
+//	@Tags			conversation
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			conversation_id	path		int						true	"Conversation ID"
+//	@Param			body			body		openai.SamplingSettings	true	"Sampling settings"
+//	@Success		200				{object}	openai.SamplingSettings
+//	@Failure		400				{object}	ErrorResponse
+//	@Failure		404				{object}	ErrorResponse
+//	@Failure		422				{object}	ErrorResponse	"invalid sampling"
+//	@Failure		500				{object}	ErrorResponse
+func SetConversationSampling(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("conversation_id"), 10, 64)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		errorJSON(c, http.StatusBadRequest, "conversation_id is invalid")
+		return
+	}
+	var sampling openai.SamplingSettings
+	if err := c.ShouldBindJSON(&sampling); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
 		return
 	}
-	c.JSON(http.StatusOK, nil)
+	if err := checkModel(sampling); err != nil {
+		writeError(c, err)
+		return
+	}
+	if err := Backend.SetConversationSampling(c.Request.Context(), uint(id), sampling); err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, sampling)
 }
 
 // SystemRoles API
@@ -116,12 +351,31 @@ func AddConversation(c *gin.Context) {
 //	@Summary		List system roles
 //	@Description	List system roles
 //	@Tags			system_role
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{array}		openai.SystemRole
-//	@Failure		500	{object}	string
+//	@Param			offset	query		int		false	"Offset"
+//	@Param			limit	query		int		false	"Page size"											default(20)	maximum(100)
+//	@Param			sort	query		string	false	"Sort column, prefix with - for descending order"	default(id)
+//	@Param			name	query		string	false	"Name contains"
+//	@Success		200		{object}	Page{items=[]openai.SystemRole}
+//	@Failure		500		{object}	ErrorResponse
+//	@Failure		400		{object}	ErrorResponse
 func ListSystemRoles(c *gin.Context) {
-
+	opts, err := listOptions(c)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	roles, total, err := Backend.ListSystemRoles(c.Request.Context(), openai.RoleFilter{
+		ListOptions:  opts,
+		NameContains: c.Query("name"),
+	})
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newPage(c, roles, total, opts))
 }
 
 // AddSystemRole doc
@@ -130,24 +384,32 @@ func ListSystemRoles(c *gin.Context) {
 //	@Summary		Add system role
 //	@Description	Add system role
 //	@Tags			system_role
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{object}	openai.SystemRole
-//	@Failure		500	{object}	string
+//	@Param			body	body		openai.SystemRole	true	"System Role"
+//	@Success		201		{object}	openai.SystemRole
+//	@Header			201		{string}	Location	"/system_roles/1"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		422		{object}	ErrorResponse	"invalid template, moderation or sampling"
+//	@Failure		500		{object}	ErrorResponse
 func AddSystemRole(c *gin.Context) {
 	// bind openai.SystemRole
 	var role openai.SystemRole
 	if err := c.ShouldBindJSON(&role); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkModel(role.Sampling); err != nil {
+		writeError(c, err)
 		return
 	}
 	// call backend
-	err := Backend.AddSystemRole(&role)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	if err := Backend.AddSystemRole(c.Request.Context(), &role); err != nil {
+		writeError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, nil)
+	created(c, fmt.Sprintf("/system_roles/%d", role.ID), role)
 }
 
 // GetSystemRole doc
@@ -156,58 +418,209 @@ func AddSystemRole(c *gin.Context) {
 //	@Summary		Get system role
 //	@Description	Get system role
 //	@Tags			system_role
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
 //	@Param			id	path		int	true	"System Role ID"
 //	@Success		200	{object}	openai.SystemRole
-//	@Failure		500	{object}	string
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
 func GetSystemRole(c *gin.Context) {
 	// bind path param: id
 	id := c.Param("id")
 	if id == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id is required"})
+		errorJSON(c, http.StatusBadRequest, "id is required")
 		return
 	}
 	// convert string to uint
 	idUint, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id is invalid"})
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
 		return
 	}
 	// call backend
-	role, err := Backend.GetSystemRole(uint(idUint))
+	role, err := Backend.GetSystemRole(c.Request.Context(), uint(idUint))
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, role)
+}
+
+// UpdateSystemRole doc
+//
+//	@Router			/system_roles/{id} [put]
+//	@Summary		Update system role
+//	@Description	Save name, content, moderation, sampling and similarity threshold as a new version. A non-zero version in the body must be the current version
+//	@Tags			system_role
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"System Role ID"
+//	@Param			body	body		openai.SystemRole	true	"System Role"
+//	@Success		200		{object}	openai.SystemRole
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Failure		409		{object}	ErrorResponse	"version conflict"
+//	@Failure		422		{object}	ErrorResponse	"invalid template, moderation or sampling"
+//	@Failure		500		{object}	ErrorResponse
+func UpdateSystemRole(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	var role openai.SystemRole
+	if err := c.ShouldBindJSON(&role); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := checkModel(role.Sampling); err != nil {
+		writeError(c, err)
+		return
+	}
+	role.ID = uint(id)
+	if err := Backend.UpdateSystemRole(c.Request.Context(), &role); err != nil {
+		writeError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, role)
 }
 
+// DeleteSystemRole doc
+//
+//	@Router			/system_roles/{id} [delete]
+//	@Summary		Delete system role
+//	@Description	Delete system role, its versions are kept for the conversations using them
+//	@Tags			system_role
+//	@Security		ApiKeyAuth
+//	@Param			id	path	int	true	"System Role ID"
+//	@Success		204
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
+func DeleteSystemRole(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	if err := Backend.DeleteSystemRole(c.Request.Context(), uint(id)); err != nil {
+		writeError(c, err)
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// ListSystemRoleVersions doc
+//
+//	@Router			/system_roles/{id}/versions [get]
+//	@Summary		List system role versions
+//	@Description	List the versions of a system role, deleted roles included
+//	@Tags			system_role
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int		true	"System Role ID"
+//	@Param			offset	query		int		false	"Offset"
+//	@Param			limit	query		int		false	"Page size"											default(20)	maximum(100)
+//	@Param			sort	query		string	false	"Sort column, prefix with - for descending order"	default(id)
+//	@Success		200		{object}	Page{items=[]openai.SystemRoleVersion}
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+func ListSystemRoleVersions(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	opts, err := listOptions(c)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	versions, total, err := Backend.ListSystemRoleVersions(c.Request.Context(), uint(id), opts)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, newPage(c, versions, total, opts))
+}
+
+// GetSystemRoleVersion doc
+//
+//	@Router			/system_roles/{id}/versions/{version} [get]
+//	@Summary		Get system role version
+//	@Description	Get a version of a system role, deleted roles included
+//	@Tags			system_role
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int	true	"System Role ID"
+//	@Param			version	path		int	true	"Version"
+//	@Success		200		{object}	openai.SystemRoleVersion
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+func GetSystemRoleVersion(c *gin.Context) {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 64)
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
+		return
+	}
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, "version is invalid")
+		return
+	}
+	v, err := Backend.GetSystemRoleVersion(c.Request.Context(), uint(id), version)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, v)
+}
+
 // Messages API
+
+// AddMessageRequest is the body of POST /messages. The completion metadata, status and token
+// counts of a message are set by the server only.
+type AddMessageRequest struct {
+	ConversationID uint   `json:"conversation_id" binding:"required"`
+	Role           string `json:"role" binding:"required"`
+	Content        string `json:"content"`
+}
+
 // AddMessages doc
 //
 //	@Router			/messages [post]
 //	@Summary		Add messages
 //	@Description	Add messages
 //	@Tags			message
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
-//	@Success		200	{object}	string
-//	@Failure		500	{object}	string
+//	@Param			body	body		AddMessageRequest	true	"Message"
+//	@Success		201		{object}	openai.ChatCompletionMessage
+//	@Header			201		{string}	Location	"/messages/1"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse	"conversation not found"
+//	@Failure		500		{object}	ErrorResponse
 func AddMessage(c *gin.Context) {
-	// bind ChatCompletionMessage
-	var msg openai.ChatCompletionMessage
-	if err := c.ShouldBindJSON(&msg); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var req AddMessageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
 		return
 	}
+	msg := openai.ChatCompletionMessage{ConversationID: req.ConversationID, Role: req.Role, Content: req.Content}
 	// call backend
-	err := Backend.AddMessages([]openai.ChatCompletionMessage{msg})
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+	msgs := []openai.ChatCompletionMessage{msg}
+	if err := Backend.AddMessages(c.Request.Context(), msgs); err != nil {
+		writeError(c, err)
 		return
 	}
-	c.JSON(http.StatusOK, nil)
+	created(c, fmt.Sprintf("/messages/%d", msgs[0].ID), msgs[0])
 }
 
 // GetMessage doc
@@ -216,87 +629,443 @@ func AddMessage(c *gin.Context) {
 //	@Summary		Get message
 //	@Description	Get message
 //	@Tags			message
+//	@Security		ApiKeyAuth
 //	@Accept			json
 //	@Produce		json
 //	@Param			id	path		int	true	"Message ID"
 //	@Success		200	{object}	openai.ChatCompletionMessage
-//	@Failure		500	{object}	string
+//	@Failure		400	{object}	ErrorResponse
+//	@Failure		404	{object}	ErrorResponse
+//	@Failure		500	{object}	ErrorResponse
 func GetMessage(c *gin.Context) {
 	// get id
 	id := c.Param("id")
 	//convert string to uint
 	idUint, err := strconv.ParseUint(id, 10, 64)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "id is invalid"})
+		errorJSON(c, http.StatusBadRequest, "id is invalid")
 		return
 	}
 	// call backend
-	msg, err := Backend.GetMessage(uint(idUint))
+	msg, err := Backend.GetMessage(c.Request.Context(), uint(idUint))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		writeError(c, err)
 		return
 	}
 	c.JSON(http.StatusOK, msg)
 }
 
-func initDB(dbPath string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("chat.db"), &gorm.Config{})
+// CompletionReport doc
+//
+//	@Router			/reports/completions [get]
+//	@Summary		Report completion calls
+//	@Description	Completion calls by model and status with truncated answers, tokens and latency
+//	@Tags			report
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			since	query		string	false	"Calls at or after, RFC3339, default is 30 days ago"
+//	@Success		200		{array}		openai.CompletionStats
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+func CompletionReport(c *gin.Context) {
+	since, err := timeQuery(c, "since")
+	if err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	if since.IsZero() {
+		since = time.Now().AddDate(0, 0, -30)
+	}
+	stats, err := Backend.CompletionStats(c.Request.Context(), since)
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stats)
+}
+
+// PurgeResponseCache doc
+//
+//	@Router			/admin/response_cache [delete]
+//	@Summary		Purge response cache
+//	@Description	Delete the cached answers of context-free prompts, admin only
+//	@Tags			admin
+//	@Security		ApiKeyAuth
+//	@Produce		json
+//	@Param			expired	query		bool	false	"Delete only expired answers"
+//	@Success		200		{object}	map[string]int64
+//	@Failure		403		{object}	ErrorResponse
+//	@Failure		404		{object}	ErrorResponse
+//	@Failure		500		{object}	ErrorResponse
+func PurgeResponseCache(c *gin.Context) {
+	if p, _ := openai.PrincipalFrom(c.Request.Context()); !p.Admin {
+		errorJSON(c, http.StatusForbidden, "admin only")
+		return
+	}
+	if Cache == nil {
+		errorJSON(c, http.StatusNotFound, "response cache is disabled")
+		return
+	}
+	n, err := Cache.PurgeResponseCache(c.Request.Context(), c.Query("expired") == "true")
+	if err != nil {
+		writeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"deleted": n})
+}
+
+// CacheReport doc
+//
+//	@Router			/reports/cache [get]
+//	@Summary		Report response cache lookups
+//	@Description	Lookups, hits and hit rate of the exact and the semantic response cache by system role since the server started, with the average similarity of semantic hits and misses for tuning thresholds
+//	@Tags			report
+//	@Security		ApiKeyAuth
+//	@Produce		json
+//	@Success		200	{array}	openai.CacheStats
+func CacheReport(c *gin.Context) {
+	c.JSON(http.StatusOK, CacheStats())
+}
+
+// LogLevel is the runtime log configuration
+type LogLevel struct {
+	// Level is "debug", "info", "warn" or "error"
+	Level string `json:"level" example:"info"`
+	// Content is how message content is logged, "omit", "redact" or "full"
+	Content string `json:"content" example:"omit"`
+}
+
+// GetLogLevel doc
+//
+//	@Router			/admin/log_level [get]
+//	@Summary		Get log level
+//	@Description	Get the log level and how message content is logged, admin only
+//	@Tags			admin
+//	@Security		ApiKeyAuth
+//	@Produce		json
+//	@Success		200	{object}	LogLevel
+//	@Failure		403	{object}	ErrorResponse
+func GetLogLevel(c *gin.Context) {
+	if p, _ := openai.PrincipalFrom(c.Request.Context()); !p.Admin {
+		errorJSON(c, http.StatusForbidden, "admin only")
+		return
+	}
+	c.JSON(http.StatusOK, LogLevel{Level: logging.GetLevel().String(), Content: logging.GetContentMode().String()})
+}
+
+// SetLogLevel doc
+//
+//	@Router			/admin/log_level [put]
+//	@Summary		Set log level
+//	@Description	Change the log level and how message content is logged until the server restarts, admin only. Omitted fields are kept.
+//	@Tags			admin
+//	@Security		ApiKeyAuth
+//	@Accept			json
+//	@Produce		json
+//	@Param			level	body		LogLevel	true	"Log level"
+//	@Success		200		{object}	LogLevel
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		403		{object}	ErrorResponse
+func SetLogLevel(c *gin.Context) {
+	if p, _ := openai.PrincipalFrom(c.Request.Context()); !p.Admin {
+		errorJSON(c, http.StatusForbidden, "admin only")
+		return
+	}
+	var req LogLevel
+	if err := c.ShouldBindJSON(&req); err != nil {
+		errorJSON(c, http.StatusBadRequest, err.Error())
+		return
+	}
+	level, mode := logging.GetLevel(), logging.GetContentMode()
+	var err error
+	if req.Level != "" {
+		if level, err = logging.ParseLevel(req.Level); err != nil {
+			errorJSON(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	if req.Content != "" {
+		if mode, err = logging.ParseContentMode(req.Content); err != nil {
+			errorJSON(c, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	logging.SetLevel(level)
+	logging.SetContentMode(mode)
+	logging.Info(c.Request.Context(), "log level changed", "level", level, "content", mode)
+	c.JSON(http.StatusOK, LogLevel{Level: level.String(), Content: mode.String()})
+}
+
+// Healthz doc
+//
+//	@Router			/healthz [get]
+//	@Summary		Liveness
+//	@Description	Answers 200 while the server process serves requests
+//	@Tags			health
+//	@Produce		json
+//	@Success		200	{object}	map[string]string
+func Healthz(c *gin.Context) {
+	health.Healthz(c)
+}
+
+// Readyz doc
+//
+//	@Router			/readyz [get]
+//	@Summary		Readiness
+//	@Description	Checks database connectivity and write access and, unless disabled, OpenAI reachability, whose result is cached. Answers 503 when a check fails.
+//	@Tags			health
+//	@Produce		json
+//	@Success		200	{object}	health.Report
+//	@Failure		503	{object}	health.Report
+func Readyz(c *gin.Context) {
+	Readiness.Readyz(c)
+}
+
+func initDB(cfg storage.Config) (*gorm.DB, error) {
+	db, err := storage.Open(cfg)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 	// Migrate the schema
-	if err := db.AutoMigrate(&openai.Conversation{}, &openai.ChatCompletionMessage{}); err != nil {
-		log.Print(err)
+	if err := migrations.Up(context.Background(), db); err != nil {
+		logging.Error(context.Background(), "migrate database", "error", err)
 		return nil, err
 	}
 	return db, nil
 }
 
+// apiKeyCommand runs "apikey create <owner> [name]", "apikey list [owner]" and
+// "apikey revoke <id>", create prints the new key
+func apiKeyCommand(ctx context.Context, args []string, scopes []string, out io.Writer) error {
+	usage := errors.New("usage: apikey create <owner> [name] [--scopes read,chat,admin] | list [owner] | revoke <id>")
+	if len(args) == 0 {
+		return usage
+	}
+	switch {
+	case args[0] == "create" && (len(args) == 2 || len(args) == 3):
+		k := openai.APIKey{Owner: args[1], Scopes: scopes}
+		if len(args) == 3 {
+			k.Name = args[2]
+		}
+		key, err := Keys.CreateAPIKey(ctx, &k)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(out, key)
+	case args[0] == "list" && len(args) <= 2:
+		f := openai.APIKeyFilter{ListOptions: openai.ListOptions{Limit: openai.MaxListLimit}, Revoked: true}
+		if len(args) == 2 {
+			f.Owner = args[1]
+		}
+		for {
+			keys, total, err := Keys.ListAPIKeys(ctx, f)
+			if err != nil {
+				return err
+			}
+			for _, k := range keys {
+				state := "active"
+				if k.Revoked() {
+					state = "revoked"
+				}
+				fmt.Fprintf(out, "%d\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Prefix, k.Owner, k.Name, strings.Join(k.Scopes, ","), state)
+			}
+			f.Offset += len(keys)
+			if len(keys) == 0 || int64(f.Offset) >= total {
+				return nil
+			}
+		}
+	case args[0] == "revoke" && len(args) == 2:
+		id, err := strconv.ParseUint(args[1], 10, 64)
+		if err != nil {
+			return usage
+		}
+		return Keys.RevokeAPIKey(ctx, uint(id))
+	default:
+		return usage
+	}
+	return nil
+}
+
 func main() {
-	// init backend
-	dbPath := pflag.StringP("dbpath", "p", "chat.db", "database path")
-	openaiToken := pflag.StringP("openai-token", "t", "", "openai token")
-	db, err := initDB(*dbPath)
+	confPath := pflag.StringP("conf", "c", "", "config file path, see config.yaml.example, flags override its values")
+	defineFlags()
+	apiKeyScopes := pflag.StringSlice("scopes", []string{openai.ScopeRead, openai.ScopeChat}, "scopes of keys created with apikey create: read, chat and admin")
+	pflag.Parse()
+	// lines of the standard log package, e.g. of dependencies, become info lines
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logging.Writer(logging.LevelInfo))
+	ctx := context.Background()
+	conf, err := initConfig(*confPath)
+	if err != nil {
+		logging.Fatal(ctx, "config", "path", *confPath, "error", err)
+	}
+	// content is redacted with the redaction rules, set the mode to redact at runtime to use them
+	contentRedactor, err := openai.NewRedactor(conf.Redaction.Rules)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "redaction rules", "error", err)
 	}
-	Backend = openai.NewGpt3p5(db, *openaiToken)
+	logging.SetContentRedactor(contentRedactor.Redact)
+	if err := conf.Log.Apply(conf.Redaction); err != nil {
+		logging.Fatal(ctx, "log config", "error", err)
+	}
+	logging.Info(ctx, "config loaded", "path", *confPath, "level", logging.GetLevel(), "content", logging.GetContentMode())
+	Models = conf.V1Models
+	// migrate status|up|down [steps]
+	if pflag.Arg(0) == "migrate" {
+		db, err := storage.Open(conf.Database)
+		if err == nil {
+			err = migrations.Command(context.Background(), db, pflag.Args()[1:], os.Stdout)
+		}
+		if err != nil {
+			logging.Fatal(ctx, "migrate", "error", err)
+		}
+		return
+	}
+	db, err := initDB(conf.Database)
+	if err != nil {
+		logging.Fatal(ctx, "init database", "error", err)
+	}
+	var storeOpts []openai.StoreOption
+	if conf.EncryptionKeyFile != "" {
+		keyring, err := encryption.LoadKeyring(conf.EncryptionKeyFile)
+		if err != nil {
+			logging.Fatal(ctx, "load encryption keys", "error", err)
+		}
+		storeOpts = append(storeOpts, openai.WithKeyring(keyring))
+	}
+	var backendOpts []openai.Option
+	if conf.Redaction.Enabled {
+		backendOpts = append(backendOpts, openai.WithRedactor(contentRedactor))
+	}
+	store := openai.NewGormStore(db, storeOpts...)
+	Keys = store
+	// apikey create|list|revoke
+	if pflag.Arg(0) == "apikey" {
+		if err := apiKeyCommand(openai.SystemContext(ctx), pflag.Args()[1:], *apiKeyScopes, os.Stdout); err != nil {
+			logging.Fatal(ctx, "apikey", "error", err)
+		}
+		return
+	}
+	if conf.ResponseCacheTTL > 0 {
+		Cache = store
+		backendOpts = append(backendOpts, openai.WithResponseCache(store, conf.ResponseCacheTTL))
+	}
+	if conf.SemanticCache.TTL > 0 {
+		e, err := openai.NewEmbedder(conf.SemanticCache.Embedder, conf.OpenaiToken)
+		if err != nil {
+			logging.Fatal(ctx, "semantic cache embedder", "error", err)
+		}
+		Cache = store
+		backendOpts = append(backendOpts, openai.WithSemanticCache(store, e, conf.SemanticCache.TTL, conf.SemanticCache.Threshold))
+	}
+	backendOpts = append(backendOpts, openai.WithProxyModeration(conf.V1Moderation))
+	gpt := openai.NewGpt3p5(store, conf.OpenaiToken, backendOpts...)
+	if err := gpt.ValidateModeration(conf.V1Moderation); err != nil {
+		logging.Fatal(ctx, "v1 moderation", "error", err)
+	}
+	Backend, CacheStats = metrics.Instrument(gpt), gpt.CacheStats
+	Readiness.Add("database", func(ctx context.Context) error {
+		return storage.Ping(ctx, db)
+	})
+	if conf.Readiness.OpenAI {
+		Readiness.AddCached("openai", gpt.Ping, conf.Readiness.OpenAITTL)
+	}
+	config.WatchLog()
 
 	// create gin handler
-	r := gin.Default()
+	r := gin.New()
+	r.Use(logging.Middleware("api"), gin.Recovery())
+
+	if len(conf.Server.TrustedProxies) > 0 {
+		if err := r.SetTrustedProxies(conf.Server.TrustedProxies); err != nil {
+			logging.Fatal(ctx, "trusted proxies", "error", err)
+		}
+	}
 
-	// create tls http server and listen 443 port
+	// stops the reload of the certificate
+	serveCtx, stopServe := context.WithCancel(ctx)
+	defer stopServe()
 	srv := &http.Server{
-		Addr:    ":443",
+		Addr:    conf.Server.ListenAddress(),
 		Handler: r,
-		TLSConfig: &tls.Config{
-			MinVersion: tls.VersionTLS10,
-		},
+	}
+	if conf.Server.TLS.Enabled {
+		if srv.TLSConfig, err = conf.Server.TLS.Config(serveCtx); err != nil {
+			logging.Fatal(ctx, "tls config", "error", err)
+		}
 	}
 
+	r.Use(metrics.Middleware("api"))
+	r.GET("/metrics", metrics.Handler())
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", Readyz)
+
 	// swagger API docs
 	r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
-	// backend API
-	r.POST("/conversations", AddConversation)
-	r.GET("/conversations", ListConversations)
-	r.GET("/conversations/:conversation_id", GetConversation)
+	// chat UI, it signs in with an api key
+	registerWeb(r)
+
+	// OpenAI compatible API
+	v1 := r.Group("/v1", authenticate(abortV1))
+	v1.GET("/models", requireScope(openai.ScopeRead, abortV1), V1ListModels)
+	v1.POST("/chat/completions", requireScope(openai.ScopeChat, abortV1), V1ChatCompletions)
 
-	r.GET("/system_roles", ListSystemRoles)
-	r.POST("/system_roles", AddSystemRole)
-	r.GET("/system_roles/:id", GetSystemRole)
+	// backend API, every request needs an api key with the scope of its route
+	api := r.Group("/", authenticate(abortJSON))
+	api.GET("/api_keys", ListAPIKeys)
+	api.GET("/api_keys/:id", GetAPIKey)
+	api.POST("/api_keys", CreateAPIKey)
+	api.DELETE("/api_keys/:id", RevokeAPIKey)
 
-	r.POST("/messages", AddMessage)
-	r.GET("/messages/:id", GetMessage)
+	read := api.Group("/", requireScope(openai.ScopeRead, abortJSON))
+	read.GET("/conversations", ListConversations)
+	read.GET("/conversations/:conversation_id", GetConversation)
+	read.GET("/conversations/:conversation_id/messages", ListMessages)
+	read.GET("/system_roles", ListSystemRoles)
+	read.GET("/system_roles/:id", GetSystemRole)
+	read.GET("/system_roles/:id/versions", ListSystemRoleVersions)
+	read.GET("/system_roles/:id/versions/:version", GetSystemRoleVersion)
+	read.GET("/messages/:id", GetMessage)
+	read.GET("/reports/completions", CompletionReport)
+
+	chat := api.Group("/", requireScope(openai.ScopeChat, abortJSON))
+	chat.POST("/conversations", AddConversation)
+	chat.PUT("/conversations/:conversation_id/sampling", SetConversationSampling)
+	chat.POST("/conversations/:conversation_id/messages", SendMessage)
+	chat.POST("/conversations/messages", SendNewConversationMessage)
+	chat.POST("/messages", AddMessage)
+
+	// chat WebSocket, browsers offer the api key as subprotocol
+	r.GET("/ws", wsProtocolKey, authenticate(abortJSON), requireScope(openai.ScopeChat, abortJSON), WebSocket)
+	if conf.EventPollInterval > 0 {
+		go Events.watch(openai.SystemContext(serveCtx), store, conf.EventPollInterval)
+	}
+	// hijacked connections are not closed by Shutdown
+	srv.RegisterOnShutdown(Events.closeAll)
+
+	admin := api.Group("/", requireScope(openai.ScopeAdmin, abortJSON))
+	admin.POST("/system_roles", AddSystemRole)
+	admin.PUT("/system_roles/:id", UpdateSystemRole)
+	admin.DELETE("/system_roles/:id", DeleteSystemRole)
+	admin.GET("/reports/cache", CacheReport)
+	admin.DELETE("/admin/response_cache", PurgeResponseCache)
+	admin.GET("/admin/log_level", GetLogLevel)
+	admin.PUT("/admin/log_level", SetLogLevel)
 
 	go func() {
 		// service connections
-		log.Print("start server")
-		certFilePath := "cert.pem"
-		keyFilePath := "key.pem"
-		if err := srv.ListenAndServeTLS(certFilePath, keyFilePath); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("listen: %s\n", err)
+		logging.Info(ctx, "start server", "addr", srv.Addr, "tls", srv.TLSConfig != nil)
+		var err error
+		if srv.TLSConfig != nil {
+			// the certificate comes from TLSConfig.GetCertificate
+			err = srv.ListenAndServeTLS("", "")
+		} else {
+			err = srv.ListenAndServe()
+		}
+		if err != nil && err != http.ErrServerClosed {
+			logging.Fatal(ctx, "listen", "error", err)
 		}
 	}()
 
@@ -309,15 +1078,15 @@ func main() {
 	// kill -9 is syscall. SIGKILL but can"t be catch, so don't need add it
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM, syscall.SIGPIPE)
 	sig := <-quit
-	log.Print("Shutdown Server ...")
+	logging.Info(ctx, "shutdown server", "signal", sig.String())
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, 3*time.Second)
 	defer cancel()
 	if err := srv.Shutdown(ctx); err != nil {
-		log.Fatal("Server Shutdown:", err)
+		logging.Fatal(ctx, "shutdown server", "error", err)
 	}
 
 	<-ctx.Done()
-	log.Print("Server exiting by signal " + sig.String())
+	logging.Info(ctx, "server exited", "signal", sig.String())
 
 }
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+// Keys authenticates the requests of the OpenAI compatible endpoints
+var Keys openai.KeyStore
+
+// Models are the models clients of the OpenAI compatible endpoints may request
+var Models []string
+
+// V1Error is the error body of the OpenAI compatible endpoints, the format of the OpenAI API
+type V1Error struct {
+	Error gogpt.APIError `json:"error"`
+}
+
+// v1Error answers code with an error in the format of the OpenAI API
+func v1Error(c *gin.Context, code int, typ, errCode, msg string) {
+	e := gogpt.APIError{Message: msg, Type: typ}
+	if errCode != "" {
+		e.Code = &errCode
+	}
+	c.AbortWithStatusJSON(code, V1Error{Error: e})
+}
+
+// abortV1 aborts a request of the OpenAI compatible endpoints
+func abortV1(c *gin.Context, code int, msg string) {
+	switch code {
+	case http.StatusUnauthorized:
+		v1Error(c, code, "invalid_request_error", "invalid_api_key", msg)
+	case http.StatusForbidden:
+		v1Error(c, code, "invalid_request_error", "insufficient_scope", msg)
+	default:
+		v1Error(c, code, "server_error", "", msg)
+	}
+}
+
+// V1ModelList is the body of GET /v1/models
+type V1ModelList struct {
+	Object string        `json:"object" example:"list"`
+	Data   []gogpt.Model `json:"data"`
+}
+
+// V1ListModels doc
+//
+//	@Router			/v1/models [get]
+//	@Summary		List models
+//	@Description	List the models of POST /v1/chat/completions, compatible with the OpenAI API. Requires an api key with the read scope.
+//	@Tags			openai
+//	@Produce		json
+//	@Security		ApiKeyAuth
+//	@Success		200	{object}	V1ModelList
+//	@Failure		401	{object}	V1Error
+func V1ListModels(c *gin.Context) {
+	list := V1ModelList{Object: "list", Data: make([]gogpt.Model, 0, len(Models))}
+	for _, m := range Models {
+		list.Data = append(list.Data, gogpt.Model{ID: m, Object: "model", OwnedBy: "openai", Root: m})
+	}
+	c.JSON(http.StatusOK, list)
+}
+
+// V1ChatCompletionChunk is a server-sent event of a streamed chat completion
+type V1ChatCompletionChunk struct {
+	ID      string                   `json:"id"`
+	Object  string                   `json:"object" example:"chat.completion.chunk"`
+	Created int64                    `json:"created"`
+	Model   string                   `json:"model"`
+	Choices []V1ChatCompletionChoice `json:"choices"`
+}
+
+// V1ChatCompletionChoice is the choice of a chunk, the first carries the role and the last the
+// finish reason
+type V1ChatCompletionChoice struct {
+	Index        int              `json:"index"`
+	Delta        V1ChatCompletion `json:"delta"`
+	FinishReason *string          `json:"finish_reason"`
+}
+
+// V1ChatCompletion is the delta of a chunk
+type V1ChatCompletion struct {
+	Role    string `json:"role,omitempty"`
+	Content string `json:"content,omitempty"`
+}
+
+// V1ChatCompletions doc
+//
+//	@Router			/v1/chat/completions [post]
+//	@Summary		Create chat completion
+//	@Description	Forward a chat completion request of an OpenAI compatible client. The request is recorded as a conversation of the owner of the api key, requires the chat scope. A request repeating the messages and the answer of an earlier one continues its conversation. With "stream": true the answer is sent as "data:" events of V1ChatCompletionChunk ending with "data: [DONE]".
+//	@Tags			openai
+//	@Accept			json
+//	@Produce		json,text/event-stream
+//	@Security		ApiKeyAuth
+//	@Param			body	body		gogpt.ChatCompletionRequest	true	"Chat completion request"
+//	@Success		200		{object}	gogpt.ChatCompletionResponse
+//	@Failure		400		{object}	V1Error
+//	@Failure		401		{object}	V1Error
+//	@Failure		404		{object}	V1Error	"unknown model"
+//	@Failure		500		{object}	V1Error
+//	@Failure		502		{object}	V1Error	"OpenAI request failed"
+func V1ChatCompletions(c *gin.Context) {
+	var req gogpt.ChatCompletionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		v1Error(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+		return
+	}
+	if !knownModel(req.Model) {
+		v1Error(c, http.StatusNotFound, "invalid_request_error", "model_not_found",
+			fmt.Sprintf("the model %q does not exist", req.Model))
+		return
+	}
+	created := time.Now().Unix()
+	if !req.Stream {
+		msg, err := Backend.Proxy(c.Request.Context(), req, nil)
+		if err != nil {
+			v1SendError(c, msg, err)
+			return
+		}
+		c.JSON(http.StatusOK, gogpt.ChatCompletionResponse{
+			ID:      v1CompletionID(msg),
+			Object:  "chat.completion",
+			Created: created,
+			Model:   msg.ModelName,
+			Choices: []gogpt.ChatCompletionChoice{{
+				Message:      gogpt.ChatCompletionMessage{Role: msg.Role, Content: msg.Content},
+				FinishReason: msg.FinishReason,
+			}},
+			Usage: gogpt.Usage{
+				PromptTokens:     msg.PromptTokens,
+				CompletionTokens: msg.CompletionTokens,
+				TotalTokens:      msg.PromptTokens + msg.CompletionTokens,
+			},
+		})
+		return
+	}
+	// the id of the answer is known when it is saved, chunks share the correlation id of the request
+	id := logging.CorrelationID(c.Request.Context())
+	if id == "" {
+		id = uuid.NewString()
+	}
+	chunk := V1ChatCompletionChunk{
+		ID:      "chatcmpl-" + id,
+		Object:  "chat.completion.chunk",
+		Created: created,
+		Model:   req.Model,
+	}
+	// errors before the first piece are answered with a status code, later ones as events
+	started := false
+	msg, err := Backend.Proxy(c.Request.Context(), req, func(delta string) error {
+		if !started {
+			started = true
+			startStream(c)
+			writeChunk(c, chunk, V1ChatCompletionChoice{Delta: V1ChatCompletion{Role: gogpt.ChatMessageRoleAssistant}})
+		}
+		writeChunk(c, chunk, V1ChatCompletionChoice{Delta: V1ChatCompletion{Content: delta}})
+		return c.Request.Context().Err()
+	})
+	if !started {
+		if err != nil {
+			v1SendError(c, msg, err)
+			return
+		}
+		startStream(c)
+		writeChunk(c, chunk, V1ChatCompletionChoice{Delta: V1ChatCompletion{Role: gogpt.ChatMessageRoleAssistant}})
+	}
+	if err != nil {
+		writeEvent(c, V1Error{Error: gogpt.APIError{Message: err.Error(), Type: "server_error"}})
+	} else {
+		finish := msg.FinishReason
+		if finish == "" {
+			finish = "stop"
+		}
+		writeChunk(c, chunk, V1ChatCompletionChoice{FinishReason: &finish})
+	}
+	fmt.Fprint(c.Writer, "data: [DONE]\n\n")
+	c.Writer.Flush()
+}
+
+func knownModel(model string) bool {
+	for _, m := range Models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// v1CompletionID is the id of the completion answered by msg
+func v1CompletionID(msg openai.ChatCompletionMessage) string {
+	return fmt.Sprintf("chatcmpl-%d", msg.ID)
+}
+
+func writeChunk(c *gin.Context, chunk V1ChatCompletionChunk, choice V1ChatCompletionChoice) {
+	chunk.Choices = []V1ChatCompletionChoice{choice}
+	writeEvent(c, chunk)
+}
+
+// writeEvent writes v as a "data:" event without event name like the OpenAI API does
+func writeEvent(c *gin.Context, v interface{}) {
+	b, _ := json.Marshal(v)
+	fmt.Fprintf(c.Writer, "data: %s\n\n", b)
+	c.Writer.Flush()
+}
+
+// v1SendError maps an error of Proxy to a status code, msg is the failed answer
+func v1SendError(c *gin.Context, msg openai.ChatCompletionMessage, err error) {
+	var policyErr *openai.PolicyError
+	var apiErr *gogpt.APIError
+	var rateErr *openai.RateLimitError
+	switch {
+	case errors.Is(err, openai.ErrInvalidProxyRequest):
+		v1Error(c, http.StatusBadRequest, "invalid_request_error", "", err.Error())
+	case errors.As(err, &policyErr):
+		v1Error(c, http.StatusBadRequest, "invalid_request_error", "content_policy_violation", policyErr.Notice)
+	case errors.Is(err, context.Canceled):
+		// the client went away, nobody reads the answer
+		c.AbortWithStatus(499)
+	case errors.As(err, &apiErr):
+		// errors of OpenAI are passed on, the status is ours except for rate limits
+		code := http.StatusBadGateway
+		if errors.As(err, &rateErr) {
+			code = http.StatusTooManyRequests
+		}
+		c.AbortWithStatusJSON(code, V1Error{Error: *apiErr})
+	case errors.As(err, &rateErr):
+		v1Error(c, http.StatusTooManyRequests, "rate_limit_error", "rate_limit_exceeded", err.Error())
+	case msg.Status == openai.MessageStatusError:
+		v1Error(c, http.StatusBadGateway, "api_error", "", err.Error())
+	default:
+		v1Error(c, http.StatusInternalServerError, "server_error", "", err.Error())
+	}
+}
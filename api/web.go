@@ -0,0 +1,27 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// webFiles is the chat UI, a static page using the REST endpoints
+//
+//go:embed web
+var webFiles embed.FS
+
+// registerWeb serves the chat UI at /ui/ and redirects / to it
+func registerWeb(r *gin.Engine) {
+	ui, err := fs.Sub(webFiles, "web")
+	if err != nil {
+		// the directory is embedded, it exists
+		panic(err)
+	}
+	r.StaticFS("/ui", http.FS(ui))
+	r.GET("/", func(c *gin.Context) {
+		c.Redirect(http.StatusFound, "/ui/")
+	})
+}
@@ -0,0 +1,475 @@
+// Chat UI of the api server. It only uses the REST endpoints, authenticated with the api key
+// the user signs in with, the key is kept in the local storage of the browser.
+"use strict";
+
+const keyStorage = "alone.apiKey";
+const pageSize = 30;
+
+const state = {
+  key: localStorage.getItem(keyStorage) || "",
+  // conv is the open conversation, null for a new chat
+  conv: null,
+  convOffset: 0,
+  messages: [],
+  sending: false,
+};
+
+const $ = (id) => document.getElementById(id);
+
+class APIError extends Error {
+  constructor(status, message) {
+    super(message);
+    this.status = status;
+  }
+}
+
+// api calls path and returns the decoded JSON body, errors of both the REST and the OpenAI
+// compatible endpoints become APIErrors
+async function api(path, options = {}) {
+  const res = await request(path, options);
+  const text = await res.text();
+  return text ? JSON.parse(text) : null;
+}
+
+async function request(path, options = {}) {
+  const headers = Object.assign({ Authorization: "Bearer " + state.key }, options.headers);
+  if (options.body !== undefined) {
+    headers["Content-Type"] = "application/json";
+  }
+  const res = await fetch(path, {
+    method: options.method || "GET",
+    headers,
+    body: options.body === undefined ? undefined : JSON.stringify(options.body),
+  });
+  if (res.ok) {
+    return res;
+  }
+  let message = res.status + " " + res.statusText;
+  try {
+    const body = await res.json();
+    const err = body.error;
+    message = (err && err.message) || err || message;
+  } catch (e) {
+    // not a JSON error body
+  }
+  if (res.status === 401) {
+    signOut(message);
+  }
+  throw new APIError(res.status, message);
+}
+
+// events reads the server-sent events of res and calls on(name, data) for each
+async function events(res, on) {
+  const reader = res.body.getReader();
+  const decoder = new TextDecoder();
+  let buffer = "";
+  for (;;) {
+    const { done, value } = await reader.read();
+    if (done) {
+      return;
+    }
+    buffer += decoder.decode(value, { stream: true });
+    let end;
+    while ((end = buffer.indexOf("\n\n")) >= 0) {
+      const block = buffer.slice(0, end);
+      buffer = buffer.slice(end + 2);
+      let name = "message";
+      const data = [];
+      for (const line of block.split("\n")) {
+        if (line.startsWith("event:")) {
+          name = line.slice(6).trim();
+        } else if (line.startsWith("data:")) {
+          data.push(line.slice(5).replace(/^ /, ""));
+        }
+      }
+      if (data.length) {
+        on(name, JSON.parse(data.join("\n")));
+      }
+    }
+  }
+}
+
+function showError(err) {
+  $("error").textContent = err ? err.message || String(err) : "";
+}
+
+// sign in
+
+function signOut(message) {
+  state.key = "";
+  disconnectEvents();
+  localStorage.removeItem(keyStorage);
+  $("app").hidden = true;
+  $("login").hidden = false;
+  $("login-error").textContent = message || "";
+}
+
+async function signIn() {
+  $("login").hidden = true;
+  $("app").hidden = false;
+  showError(null);
+  connectEvents();
+  try {
+    await Promise.all([loadRoles(), loadModels(), loadConversations(true)]);
+  } catch (err) {
+    showError(err);
+  }
+}
+
+$("login").addEventListener("submit", (e) => {
+  e.preventDefault();
+  state.key = $("api-key").value.trim();
+  localStorage.setItem(keyStorage, state.key);
+  $("api-key").value = "";
+  signIn();
+});
+
+$("logout").addEventListener("click", () => signOut());
+
+// events of the chat WebSocket, messages are sent with the REST endpoints but messages added by
+// other clients, e.g. the Synology bot, are reported here
+
+const live = {
+  socket: null,
+  reconnect: null,
+  refresh: null,
+  // updated are the ids of the conversations updated since the last refresh
+  updated: new Set(),
+};
+
+function connectEvents() {
+  if (live.socket || !("WebSocket" in window)) {
+    return;
+  }
+  const url = (location.protocol === "https:" ? "wss://" : "ws://") + location.host + "/ws";
+  // browsers can not set the Authorization header, the key is offered as subprotocol
+  const socket = new WebSocket(url, ["alone.chat.v1", "api-key." + state.key]);
+  live.socket = socket;
+  socket.addEventListener("message", (e) => {
+    const ev = JSON.parse(e.data);
+    if (ev.type === "conversation.updated") {
+      live.updated.add(ev.conversation_id);
+      clearTimeout(live.refresh);
+      live.refresh = setTimeout(refreshUpdated, 300);
+    }
+  });
+  socket.addEventListener("close", () => {
+    if (live.socket !== socket) {
+      return;
+    }
+    live.socket = null;
+    if (state.key) {
+      live.reconnect = setTimeout(connectEvents, 5000);
+    }
+  });
+}
+
+function disconnectEvents() {
+  clearTimeout(live.reconnect);
+  clearTimeout(live.refresh);
+  const socket = live.socket;
+  live.socket = null;
+  if (socket) {
+    socket.close();
+  }
+}
+
+// refreshUpdated reloads the open conversation and the list when they were updated
+async function refreshUpdated() {
+  if (state.sending) {
+    live.refresh = setTimeout(refreshUpdated, 1000);
+    return;
+  }
+  const updated = live.updated;
+  live.updated = new Set();
+  const listed = new Set(Array.from($("conversations").children, (li) => Number(li.dataset.id)));
+  try {
+    if (state.conv && updated.has(state.conv.ID)) {
+      await openConversation(state.conv.ID);
+    }
+    if (Array.from(updated).some((id) => !listed.has(id))) {
+      await loadConversations(true);
+    }
+  } catch (err) {
+    showError(err);
+  }
+}
+
+// pickers
+
+async function loadRoles() {
+  const page = await api("/system_roles?limit=100&sort=name");
+  const select = $("role");
+  select.length = 1;
+  for (const role of page.items) {
+    select.add(new Option(role.name, role.ID));
+  }
+}
+
+async function loadModels() {
+  const list = await api("/v1/models");
+  const select = $("model");
+  select.length = 1;
+  for (const model of list.data) {
+    select.add(new Option(model.id, model.id));
+  }
+}
+
+// the model of an open conversation is its sampling override
+$("model").addEventListener("change", async () => {
+  if (!state.conv) {
+    return;
+  }
+  const sampling = Object.assign({}, state.conv.sampling);
+  if ($("model").value) {
+    sampling.model = $("model").value;
+  } else {
+    delete sampling.model;
+  }
+  try {
+    await api(`/conversations/${state.conv.ID}/sampling`, { method: "PUT", body: sampling });
+    state.conv.sampling = sampling;
+    showError(null);
+  } catch (err) {
+    $("model").value = (state.conv.sampling && state.conv.sampling.model) || "";
+    showError(err);
+  }
+});
+
+// conversations
+
+async function loadConversations(reset) {
+  if (reset) {
+    state.convOffset = 0;
+    $("conversations").textContent = "";
+  }
+  const page = await api(`/conversations?sort=-id&limit=${pageSize}&offset=${state.convOffset}`);
+  for (const conv of page.items) {
+    $("conversations").append(conversationItem(conv));
+  }
+  state.convOffset += page.items.length;
+  $("more-conversations").hidden = !page.next;
+}
+
+function conversationItem(conv) {
+  const li = document.createElement("li");
+  li.textContent = conv.name || "Conversation " + conv.ID;
+  li.title = li.textContent;
+  li.dataset.id = conv.ID;
+  li.classList.toggle("active", state.conv !== null && state.conv.ID === conv.ID);
+  li.addEventListener("click", () => {
+    if (!state.sending) {
+      openConversation(conv.ID).catch(showError);
+    }
+  });
+  return li;
+}
+
+function markActive() {
+  for (const li of $("conversations").children) {
+    li.classList.toggle("active", state.conv !== null && li.dataset.id === String(state.conv.ID));
+  }
+}
+
+$("more-conversations").addEventListener("click", () => loadConversations(false).catch(showError));
+
+async function openConversation(id) {
+  showError(null);
+  const conv = await api(`/conversations/${id}`);
+  // all pages of the messages, oldest first
+  const messages = [];
+  let next = `/conversations/${id}/messages?sort=id&limit=100`;
+  while (next) {
+    const page = await api(next);
+    messages.push(...page.items);
+    next = page.next;
+  }
+  state.conv = conv;
+  state.messages = messages;
+  $("role").value = conv.system_role_id || 0;
+  $("role").disabled = true;
+  $("model").value = (conv.sampling && conv.sampling.model) || "";
+  markActive();
+  renderMessages();
+}
+
+function newChat() {
+  if (state.sending) {
+    return;
+  }
+  state.conv = null;
+  state.messages = [];
+  $("role").disabled = false;
+  showError(null);
+  markActive();
+  renderMessages();
+  $("input").focus();
+}
+
+$("new-chat").addEventListener("click", newChat);
+
+// messages
+
+function renderMessages() {
+  $("messages").textContent = "";
+  for (const msg of state.messages) {
+    $("messages").append(messageElement(msg));
+  }
+  renderTotal();
+  scrollDown();
+}
+
+function messageElement(msg) {
+  const div = document.createElement("div");
+  const content = document.createElement("div");
+  const meta = document.createElement("div");
+  content.className = "content";
+  meta.className = "meta";
+  div.append(content, meta);
+  updateMessage(div, msg);
+  return div;
+}
+
+// updateMessage shows msg in the element div made by messageElement
+function updateMessage(div, msg) {
+  const failed = msg.status === "error" || msg.status === "rejected" || msg.flagged;
+  div.className = "message " + msg.role + (failed ? " error" : "");
+  div.querySelector(".content").textContent = msg.content;
+  div.querySelector(".meta").textContent = messageMeta(msg);
+}
+
+function messageMeta(msg) {
+  const parts = [];
+  if (msg.role === "assistant" && msg.status !== "error") {
+    if (msg.model) {
+      parts.push(msg.model);
+    }
+    parts.push(`${msg.prompt_tokens || 0} prompt + ${msg.completion_tokens || 0} completion tokens`);
+    parts.push(formatCost(msg.cost_usd || 0));
+    if (msg.cached) {
+      parts.push("cached");
+    }
+  }
+  if (msg.moderation_reasons) {
+    parts.push("flagged: " + msg.moderation_reasons);
+  }
+  if (msg.error) {
+    parts.push(msg.error);
+  }
+  return parts.join(" · ");
+}
+
+function formatCost(usd) {
+  return "$" + usd.toFixed(usd < 0.01 ? 6 : 4);
+}
+
+function renderTotal() {
+  let tokens = 0;
+  let cost = 0;
+  for (const msg of state.messages) {
+    tokens += (msg.prompt_tokens || 0) + (msg.completion_tokens || 0);
+    cost += msg.cost_usd || 0;
+  }
+  $("total").textContent = state.messages.length ? `${tokens} tokens · ${formatCost(cost)}` : "";
+}
+
+function scrollDown() {
+  $("messages").scrollTop = $("messages").scrollHeight;
+}
+
+// sending
+
+async function send(content) {
+  const user = { role: "user", content };
+  const answer = { role: "assistant", content: "" };
+  const userDiv = messageElement(user);
+  const answerDiv = messageElement(answer);
+  $("messages").append(userDiv, answerDiv);
+  scrollDown();
+
+  const body = { content, stream: true, locale: navigator.language };
+  let path = "/conversations/messages";
+  if (state.conv) {
+    path = `/conversations/${state.conv.ID}/messages`;
+  } else {
+    body.system_role_id = Number($("role").value);
+    if ($("model").value) {
+      body.sampling = { model: $("model").value };
+    }
+  }
+  let res;
+  try {
+    res = await request(path, {
+      method: "POST",
+      headers: { Accept: "text/event-stream" },
+      body,
+    });
+  } catch (err) {
+    answerDiv.remove();
+    user.error = err.message;
+    updateMessage(userDiv, Object.assign(user, { status: "error" }));
+    throw err;
+  }
+  let done = null;
+  await events(res, (name, data) => {
+    switch (name) {
+      case "delta":
+        answer.content += data.content;
+        updateMessage(answerDiv, answer);
+        scrollDown();
+        break;
+      case "message":
+        done = Object.assign({}, data.message, { cost_usd: data.usage.cost_usd });
+        updateMessage(answerDiv, done);
+        break;
+      case "error":
+        updateMessage(answerDiv, Object.assign(answer, { status: "error", error: data.error }));
+        break;
+    }
+  });
+  if (!done) {
+    return;
+  }
+  if (state.conv) {
+    state.messages.push(user, done);
+    renderTotal();
+    return;
+  }
+  // the first message created the conversation, load it with its stored messages
+  await openConversation(done.conversation_id);
+  await loadConversations(true);
+}
+
+$("composer").addEventListener("submit", async (e) => {
+  e.preventDefault();
+  const content = $("input").value.trim();
+  if (!content || state.sending) {
+    return;
+  }
+  state.sending = true;
+  $("send").disabled = true;
+  $("input").value = "";
+  showError(null);
+  try {
+    await send(content);
+  } catch (err) {
+    showError(err);
+  } finally {
+    state.sending = false;
+    $("send").disabled = false;
+    $("input").focus();
+  }
+});
+
+$("input").addEventListener("keydown", (e) => {
+  if (e.key === "Enter" && !e.shiftKey && !e.isComposing) {
+    e.preventDefault();
+    $("composer").requestSubmit();
+  }
+});
+
+if (state.key) {
+  signIn();
+} else {
+  signOut();
+}
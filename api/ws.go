@@ -0,0 +1,453 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+)
+
+// Events pushes the messages added to conversations, also by other processes like the Synology
+// bot, to the WebSocket connections allowed to read them
+var Events = newEventHub()
+
+const (
+	// wsProtocol is the subprotocol of the chat WebSocket, clients must offer it
+	wsProtocol = "alone.chat.v1"
+	// wsKeyProtocol prefixes an api key offered as subprotocol by clients that can not set the
+	// Authorization header, e.g. browsers
+	wsKeyProtocol = "api-key."
+
+	wsWriteWait  = 10 * time.Second
+	wsPongWait   = 60 * time.Second
+	wsPingPeriod = wsPongWait * 9 / 10
+	wsMaxFrame   = 1 << 20
+	// wsMaxGenerations limits the in-flight generations of a connection
+	wsMaxGenerations = 8
+	// wsUpdateBuffer is the number of "conversation.updated" events queued for a connection,
+	// further events are dropped until the client catches up
+	wsUpdateBuffer = 32
+)
+
+// websocket event types
+const (
+	wsStarted             = "started"
+	wsDelta               = "delta"
+	wsMessage             = "message"
+	wsError               = "error"
+	wsCanceled            = "canceled"
+	wsConversationUpdated = "conversation.updated"
+)
+
+var upgrader = websocket.Upgrader{Subprotocols: []string{wsProtocol}}
+
+// WSRequest is a frame sent by the client. Type "send" sends a user message to the conversation
+// ConversationID, or starts a conversation with the fields of NewConversationMessageRequest when
+// it is zero, answers are always streamed. Type "cancel" cancels the generation ID.
+type WSRequest struct {
+	Type string `json:"type" example:"send"`
+	// ID identifies the generation in its events, it is chosen by the client and unique among the
+	// in-flight generations of the connection
+	ID             string `json:"id" example:"1"`
+	ConversationID uint   `json:"conversation_id,omitempty"`
+	NewConversationMessageRequest
+}
+
+// WSEvent is a frame sent by the server. A generation sends "started" once its conversation is
+// known, "delta" events with StreamDelta data, and ends with a "message" event with
+// SendMessageResponse data, an "error" event with the status and the error body of the REST
+// endpoints, or "canceled". "conversation.updated" events with ConversationUpdate data report
+// the messages added to the conversations the api key can read, it needs the read scope.
+type WSEvent struct {
+	Type           string      `json:"type"`
+	ID             string      `json:"id,omitempty"`
+	ConversationID uint        `json:"conversation_id,omitempty"`
+	Status         int         `json:"status,omitempty"`
+	Data           interface{} `json:"data,omitempty"`
+}
+
+// ConversationUpdate is the data of a "conversation.updated" event
+type ConversationUpdate struct {
+	Conversation openai.Conversation          `json:"conversation"`
+	Message      openai.ChatCompletionMessage `json:"message"`
+}
+
+// wsProtocolKey moves an api key offered as subprotocol "api-key.<key>" to the Authorization
+// header for authenticate
+func wsProtocolKey(c *gin.Context) {
+	if c.GetHeader("Authorization") != "" {
+		return
+	}
+	for _, p := range websocket.Subprotocols(c.Request) {
+		if strings.HasPrefix(p, wsKeyProtocol) {
+			c.Request.Header.Set("Authorization", "Bearer "+strings.TrimPrefix(p, wsKeyProtocol))
+			return
+		}
+	}
+}
+
+// WebSocket doc
+//
+//	@Router			/ws [get]
+//	@Summary		Chat WebSocket
+//	@Description	Upgrade to a WebSocket of subprotocol "alone.chat.v1" that multiplexes generations in several conversations. Clients send WSRequest frames and receive WSEvent frames. Browsers offer the api key as subprotocol "api-key.<key>" besides "alone.chat.v1".
+//	@Tags			message
+//	@Security		ApiKeyAuth
+//	@Param			body	body		WSRequest	false	"Frames sent by the client"
+//	@Success		101		{object}	WSEvent		"Frames sent by the server"
+//	@Failure		400		{object}	ErrorResponse
+//	@Failure		401		{object}	ErrorResponse
+//	@Failure		403		{object}	ErrorResponse
+func WebSocket(c *gin.Context) {
+	header := http.Header{logging.CorrelationHeader: {c.Writer.Header().Get(logging.CorrelationHeader)}}
+	conn, err := upgrader.Upgrade(c.Writer, c.Request, header)
+	if err != nil {
+		// the upgrader answered the request
+		return
+	}
+	key := requestKey(c)
+	wc := newWSConn(c.Request.Context(), conn, key.Principal(), key.HasScope(openai.ScopeRead))
+	Events.add(wc)
+	defer Events.remove(wc)
+	logging.Info(wc.ctx, "websocket opened", "owner", key.Owner, "api_key_id", key.ID)
+	wc.serve()
+	logging.Info(wc.ctx, "websocket closed", "owner", key.Owner, "api_key_id", key.ID)
+}
+
+// wsConn is a chat WebSocket connection
+type wsConn struct {
+	conn      *websocket.Conn
+	principal openai.Principal
+	// updates queues the "conversation.updated" events, it is nil without the read scope
+	updates chan WSEvent
+
+	// ctx is done when the connection ends, it cancels the generations
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// writeMu serializes the writes, a connection supports one concurrent writer
+	writeMu sync.Mutex
+
+	mu sync.Mutex
+	// generations cancel the in-flight generations by id
+	generations map[string]context.CancelFunc
+	// busy are the conversations with an in-flight generation
+	busy map[uint]bool
+}
+
+func newWSConn(ctx context.Context, conn *websocket.Conn, p openai.Principal, events bool) *wsConn {
+	wc := &wsConn{
+		conn:        conn,
+		principal:   p,
+		generations: make(map[string]context.CancelFunc),
+		busy:        make(map[uint]bool),
+	}
+	wc.ctx, wc.cancel = context.WithCancel(ctx)
+	if events {
+		wc.updates = make(chan WSEvent, wsUpdateBuffer)
+	}
+	return wc
+}
+
+// serve reads the frames of the client until the connection ends
+func (wc *wsConn) serve() {
+	defer func() {
+		wc.cancel()
+		wc.wg.Wait()
+		wc.conn.Close()
+	}()
+	wc.conn.SetReadLimit(wsMaxFrame)
+	wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	wc.conn.SetPongHandler(func(string) error {
+		return wc.conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+	wc.wg.Add(1)
+	go wc.writeUpdates()
+	for {
+		_, data, err := wc.conn.ReadMessage()
+		if err != nil {
+			if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				logging.Info(wc.ctx, "websocket read", "error", err)
+			}
+			return
+		}
+		var req WSRequest
+		if err := json.Unmarshal(data, &req); err != nil {
+			wc.writeError(WSRequest{}, http.StatusBadRequest, "invalid frame: "+err.Error())
+			continue
+		}
+		switch req.Type {
+		case "send":
+			wc.start(req)
+		case "cancel":
+			wc.mu.Lock()
+			cancel, ok := wc.generations[req.ID]
+			wc.mu.Unlock()
+			if !ok {
+				wc.writeError(req, http.StatusNotFound, fmt.Sprintf("no generation %q in flight", req.ID))
+				continue
+			}
+			cancel()
+		default:
+			wc.writeError(req, http.StatusBadRequest, fmt.Sprintf("unknown frame type %q, expect send or cancel", req.Type))
+		}
+	}
+}
+
+// start starts the generation of req unless it conflicts with the in-flight ones
+func (wc *wsConn) start(req WSRequest) {
+	if req.ID == "" || req.Content == "" {
+		wc.writeError(req, http.StatusBadRequest, "id and content are required")
+		return
+	}
+	wc.mu.Lock()
+	defer wc.mu.Unlock()
+	switch {
+	case wc.generations[req.ID] != nil:
+		wc.writeError(req, http.StatusConflict, fmt.Sprintf("generation %q is in flight", req.ID))
+		return
+	case wc.busy[req.ConversationID]:
+		wc.writeError(req, http.StatusConflict, fmt.Sprintf("conversation %d has a generation in flight", req.ConversationID))
+		return
+	case len(wc.generations) >= wsMaxGenerations:
+		wc.writeError(req, http.StatusTooManyRequests, fmt.Sprintf("at most %d generations are in flight", wsMaxGenerations))
+		return
+	}
+	ctx, cancel := context.WithCancel(wc.ctx)
+	wc.generations[req.ID] = cancel
+	if req.ConversationID != 0 {
+		wc.busy[req.ConversationID] = true
+	}
+	wc.wg.Add(1)
+	go func() {
+		defer wc.wg.Done()
+		id := wc.generate(ctx, req)
+		cancel()
+		wc.mu.Lock()
+		delete(wc.generations, req.ID)
+		delete(wc.busy, id)
+		wc.mu.Unlock()
+	}()
+}
+
+// generate sends the message of req and writes the events of the answer, it returns the id of
+// the conversation
+func (wc *wsConn) generate(ctx context.Context, req WSRequest) uint {
+	id := req.ConversationID
+	if id == 0 {
+		conv, err := startConversation(ctx, req.NewConversationMessageRequest)
+		if err != nil {
+			code, body := errorResponse(err)
+			wc.write(WSEvent{Type: wsError, ID: req.ID, Status: code, Data: body})
+			return 0
+		}
+		id = conv.ID
+		wc.mu.Lock()
+		wc.busy[id] = true
+		wc.mu.Unlock()
+	}
+	if err := wc.write(WSEvent{Type: wsStarted, ID: req.ID, ConversationID: id}); err != nil {
+		return id
+	}
+	msg, err := Backend.SendStream(sendContext(ctx, req.SendMessageRequest), id, req.Content, func(delta string) error {
+		if err := wc.write(WSEvent{Type: wsDelta, ID: req.ID, ConversationID: id, Data: StreamDelta{Content: delta}}); err != nil {
+			return err
+		}
+		return ctx.Err()
+	})
+	ev := WSEvent{ID: req.ID, ConversationID: id}
+	switch {
+	case err == nil:
+		ev.Type, ev.Data = wsMessage, newSendMessageResponse(msg)
+	case errors.Is(err, context.Canceled):
+		ev.Type = wsCanceled
+	default:
+		ev.Type = wsError
+		ev.Status, ev.Data = sendErrorResponse(msg, err)
+	}
+	wc.write(ev)
+	return id
+}
+
+// writeUpdates writes the queued "conversation.updated" events until the connection ends
+func (wc *wsConn) writeUpdates() {
+	defer wc.wg.Done()
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-wc.ctx.Done():
+			return
+		case ev := <-wc.updates:
+			if err := wc.write(ev); err != nil {
+				return
+			}
+		case <-ticker.C:
+			if err := wc.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// push queues ev for the client, it is dropped when the queue is full
+func (wc *wsConn) push(ev WSEvent) {
+	select {
+	case wc.updates <- ev:
+	default:
+		logging.Warn(wc.ctx, "websocket event dropped", "type", ev.Type, "conversation_id", ev.ConversationID)
+	}
+}
+
+// canRead reports whether the connection receives the events of conv
+func (wc *wsConn) canRead(conv openai.Conversation) bool {
+	return wc.updates != nil && (wc.principal.Admin || wc.principal.Owner == conv.Owner)
+}
+
+func (wc *wsConn) write(ev WSEvent) error {
+	wc.writeMu.Lock()
+	defer wc.writeMu.Unlock()
+	wc.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return wc.conn.WriteJSON(ev)
+}
+
+func (wc *wsConn) writeError(req WSRequest, code int, msg string) {
+	wc.write(WSEvent{Type: wsError, ID: req.ID, ConversationID: req.ConversationID, Status: code, Data: newErrorResponse(code, msg)})
+}
+
+// eventHub tracks the WebSocket connections and pushes the added messages to them
+type eventHub struct {
+	mu    sync.Mutex
+	conns map[*wsConn]bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{conns: make(map[*wsConn]bool)}
+}
+
+func (h *eventHub) add(wc *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.conns[wc] = true
+}
+
+func (h *eventHub) remove(wc *wsConn) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.conns, wc)
+}
+
+// closeAll closes the connections with "going away", e.g. when the server shuts down
+func (h *eventHub) closeAll() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	msg := websocket.FormatCloseMessage(websocket.CloseGoingAway, "server shutting down")
+	for wc := range h.conns {
+		wc.conn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(wsWriteWait))
+		wc.conn.Close()
+	}
+}
+
+// watch polls store for added messages every interval until ctx is done and pushes them as
+// "conversation.updated" events. The messages of other processes sharing the database, e.g.
+// of the Synology bot, are seen like the messages of this server.
+func (h *eventHub) watch(ctx context.Context, store openai.Store, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	// messages after the latest one at start are pushed
+	var last uint
+	started := false
+	for {
+		if !started {
+			ms, _, err := store.ListMessages(ctx, openai.MessageFilter{ListOptions: openai.ListOptions{Limit: 1, Sort: "-id"}})
+			if err != nil {
+				logging.Warn(ctx, "poll messages", "error", err)
+			} else {
+				started = true
+				if len(ms) > 0 {
+					last = ms[0].ID
+				}
+			}
+		} else {
+			last = h.poll(ctx, store, last)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll pushes the messages added after the message last and returns the id of the last pushed
+// message, failed queries are retried by the next poll
+func (h *eventHub) poll(ctx context.Context, store openai.Store, last uint) uint {
+	for {
+		ms, _, err := store.ListMessages(ctx, openai.MessageFilter{
+			ListOptions: openai.ListOptions{Limit: openai.MaxListLimit},
+			AfterID:     last,
+		})
+		if err != nil {
+			logging.Warn(ctx, "poll messages", "error", err)
+			return last
+		}
+		if len(ms) == 0 {
+			return last
+		}
+		var ids []uint
+		seen := make(map[uint]bool)
+		for _, m := range ms {
+			if !seen[m.ConversationID] {
+				seen[m.ConversationID] = true
+				ids = append(ids, m.ConversationID)
+			}
+		}
+		convs, _, err := store.ListConversations(ctx, openai.ConversationFilter{
+			ListOptions: openai.ListOptions{Limit: openai.MaxListLimit},
+			IDs:         ids,
+		})
+		if err != nil {
+			logging.Warn(ctx, "poll conversations", "error", err)
+			return last
+		}
+		byID := make(map[uint]openai.Conversation, len(convs))
+		for _, c := range convs {
+			byID[c.ID] = c
+		}
+		for _, m := range ms {
+			// messages of deleted conversations are skipped
+			if conv, ok := byID[m.ConversationID]; ok {
+				h.broadcast(WSEvent{
+					Type:           wsConversationUpdated,
+					ConversationID: conv.ID,
+					Data:           ConversationUpdate{Conversation: conv, Message: m},
+				}, conv)
+			}
+			last = m.ID
+		}
+		if len(ms) < openai.MaxListLimit {
+			return last
+		}
+	}
+}
+
+// broadcast pushes ev to the connections that can read conv
+func (h *eventHub) broadcast(ev WSEvent, conv openai.Conversation) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for wc := range h.conns {
+		if wc.canRead(conv) {
+			wc.push(ev)
+		}
+	}
+}
@@ -5,45 +5,45 @@ import (
 	"context"
 	"encoding/gob"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
 	"strings"
 	"sync"
 	"syscall"
 	"time"
 
+	"github.com/coolbit-in/alone/config"
+	"github.com/coolbit-in/alone/encryption"
+	"github.com/coolbit-in/alone/health"
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/metrics"
 	"github.com/coolbit-in/alone/openai"
+	"github.com/coolbit-in/alone/storage"
+	"github.com/coolbit-in/alone/storage/migrations"
 
-	l "log"
+	stdlog "log"
 
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
-	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
 )
 
-var (
-	log *l.Logger
-)
-
-func init() {
-	log = l.New(os.Stderr, "", l.LstdFlags|l.Lshortfile)
-}
-
-func initDB(dbPath string) (*gorm.DB, error) {
-	db, err := gorm.Open(sqlite.Open("chat.db"), &gorm.Config{})
+func initDB(cfg storage.Config) (*gorm.DB, error) {
+	db, err := storage.Open(cfg)
 	if err != nil {
-		log.Print(err)
 		return nil, err
 	}
 	// Migrate the schema
-	if err := db.AutoMigrate(&openai.Conversation{}, &openai.ChatCompletionMessage{}); err != nil {
-		log.Print(err)
+	if err := migrations.Up(context.Background(), db); err != nil {
+		logging.Error(context.Background(), "migrate database", "error", err)
 		return nil, err
 	}
 	return db, nil
@@ -53,6 +53,12 @@ type Session struct {
 	UserID        uint `json:"user_id"`
 	ConvID        uint `json:"conv_id"`
 	EnableContext bool `json:"enable_context"`
+	// SystemRoleID is the system role of new conversations, Locale and Fields are its template variables
+	SystemRoleID uint              `json:"system_role_id"`
+	Locale       string            `json:"locale"`
+	Fields       map[string]string `json:"fields"`
+	// Sampling overrides the sampling defaults of the system role in the user's conversations
+	Sampling openai.SamplingSettings `json:"sampling"`
 }
 type SynologyChatBot struct {
 	backend  openai.GptBackend
@@ -62,6 +68,8 @@ type SynologyChatBot struct {
 	nasDomain string
 	// enableContext bool
 	sessions sync.Map
+	// readiness checks the dependencies of the bot for /readyz
+	readiness *health.Checker
 }
 
 func (bot *SynologyChatBot) GetSession(userID uint) (Session, bool) {
@@ -120,7 +128,8 @@ func (bot *SynologyChatBot) LoadSessions(filePath string) error {
 	var decodedSession Session
 	dec := gob.NewDecoder(bytes.NewReader(sessionBytes))
 	for dec.Decode(&decodedSession) == nil {
-		log.Print(decodedSession.UserID, decodedSession.ConvID, decodedSession.EnableContext)
+		logging.Debug(context.Background(), "session loaded", "user_id", decodedSession.UserID,
+			"conv_id", decodedSession.ConvID, "enable_context", decodedSession.EnableContext)
 		bot.sessions.Store(decodedSession.UserID, decodedSession)
 	}
 	return nil
@@ -129,15 +138,44 @@ func (bot *SynologyChatBot) LoadSessions(filePath string) error {
 func NewSynologyChatBot(backend openai.GptBackend, token string, nasDomain string) *SynologyChatBot {
 	bot := &SynologyChatBot{
 		backend:   backend,
-		router:    gin.Default(),
+		router:    gin.New(),
 		botToken:  token,
 		nasDomain: nasDomain,
 		sessions:  sync.Map{},
+		readiness: health.New(),
+	}
+	bot.readiness.Add("synology", bot.checkSynology)
+	if err := bot.LoadSessions("sessions.gob"); err != nil && !os.IsNotExist(err) {
+		logging.Error(context.Background(), "load sessions", "error", err)
 	}
-	bot.LoadSessions("sessions.gob")
+	bot.router.Use(logging.Middleware("bot"), gin.Recovery(), metrics.Middleware("bot"))
+	metrics.Sessions(func() int {
+		n := 0
+		bot.sessions.Range(func(k, v interface{}) bool {
+			n++
+			return true
+		})
+		return n
+	})
 	return bot
 }
 
+// checkSynology checks the configuration of the Synology Chat incoming webhook that answers
+// are sent to, it does not call the NAS
+func (bot *SynologyChatBot) checkSynology(ctx context.Context) error {
+	if bot.botToken == "" {
+		return errors.New("bot_token is not configured")
+	}
+	u, err := url.Parse(bot.nasDomain)
+	if err != nil {
+		return fmt.Errorf("nas_domain: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("nas_domain %q is not an http or https url", bot.nasDomain)
+	}
+	return nil
+}
+
 // EnableContext enable converstion context for gpt
 func (bot *SynologyChatBot) EnableContext(userID uint) {
 	session, bool := bot.GetSession(userID)
@@ -170,6 +208,193 @@ func (bot *SynologyChatBot) ResetConversation(userID uint) {
 	bot.SetSession(userID, session)
 }
 
+// synologyOwner is the owner of conversations of a Synology Chat user
+func synologyOwner(userID uint) string {
+	return fmt.Sprintf("synology:%d", userID)
+}
+
+// userContext returns ctx acting on behalf of a Synology Chat user
+func userContext(ctx context.Context, userID uint) context.Context {
+	return openai.WithPrincipal(ctx, openai.Principal{Owner: synologyOwner(userID)})
+}
+
+// templateContext returns the user context carrying the template variables of the session
+func templateContext(ctx context.Context, session Session, username string) context.Context {
+	return openai.WithTemplateVars(userContext(ctx, session.UserID), openai.TemplateVars{
+		Username: username,
+		Locale:   session.Locale,
+		Fields:   session.Fields,
+	})
+}
+
+// ListSystemRoles returns the system roles as answer text
+func (bot *SynologyChatBot) ListSystemRoles(ctx context.Context) string {
+	roles, total, err := bot.backend.ListSystemRoles(ctx, openai.RoleFilter{
+		ListOptions: openai.ListOptions{Limit: openai.MaxListLimit, Sort: "id"},
+	})
+	if err != nil {
+		logging.Error(ctx, "list system roles", "error", err)
+		return "Failed to list system roles"
+	}
+	if total == 0 {
+		return "No system roles"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d system roles:\n", total)
+	for _, role := range roles {
+		fmt.Fprintf(&b, "[role_id: %d] %s (v%d)\n", role.ID, role.Name, role.Version)
+	}
+	return b.String()
+}
+
+// SetSystemRole selects the system role of new conversations and resets the conversation,
+// args is the role id, 0 disables the system role
+func (bot *SynologyChatBot) SetSystemRole(ctx context.Context, userID uint, args []string) string {
+	usage := "Usage: /botconf role <role_id>"
+	if len(args) != 1 {
+		return usage
+	}
+	roleID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return usage
+	}
+	if roleID != 0 {
+		if _, err := bot.backend.GetSystemRole(ctx, uint(roleID)); err != nil {
+			logging.Warn(ctx, "get system role", "system_role_id", roleID, "error", err)
+			return fmt.Sprintf("System role %d not found", roleID)
+		}
+	}
+	session := bot.session(userID)
+	session.SystemRoleID = uint(roleID)
+	session.ConvID = 0
+	bot.SetSession(userID, session)
+	if roleID == 0 {
+		return "System role disabled, conversation reseted"
+	}
+	return fmt.Sprintf("System role %d selected, conversation reseted", roleID)
+}
+
+// SetLocale sets the locale template variable, no args clears it
+func (bot *SynologyChatBot) SetLocale(userID uint, args []string) string {
+	if len(args) > 1 {
+		return "Usage: /botconf locale [locale]"
+	}
+	session := bot.session(userID)
+	session.Locale = strings.Join(args, "")
+	bot.SetSession(userID, session)
+	return fmt.Sprintf("Locale set to %q", session.Locale)
+}
+
+// SetField sets the custom template variable args[0] to the rest of args, no value removes it
+func (bot *SynologyChatBot) SetField(userID uint, args []string) string {
+	if len(args) == 0 {
+		return "Usage: /botconf field <name> [value]"
+	}
+	session := bot.session(userID)
+	fields := make(map[string]string, len(session.Fields)+1)
+	for k, v := range session.Fields {
+		fields[k] = v
+	}
+	if len(args) == 1 {
+		delete(fields, args[0])
+	} else {
+		fields[args[0]] = strings.Join(args[1:], " ")
+	}
+	session.Fields = fields
+	bot.SetSession(userID, session)
+	if len(args) == 1 {
+		return fmt.Sprintf("Field %s removed", args[0])
+	}
+	return fmt.Sprintf("Field %s set", args[0])
+}
+
+// SetSampling sets the sampling parameter args[0] to args[1] for the current and new conversations,
+// no value unsets it
+func (bot *SynologyChatBot) SetSampling(ctx context.Context, userID uint, args []string) string {
+	if len(args) == 0 || len(args) > 2 {
+		return "Usage: /botconf set <temperature|top_p|max_tokens|presence_penalty|frequency_penalty|stop> [value]"
+	}
+	session := bot.session(userID)
+	sampling := session.Sampling
+	if err := sampling.Set(args[0], strings.Join(args[1:], "")); err != nil {
+		return err.Error()
+	}
+	if session.ConvID != 0 {
+		if err := bot.backend.SetConversationSampling(userContext(ctx, userID), session.ConvID, sampling); err != nil {
+			logging.Error(ctx, "set conversation sampling", "conv_id", session.ConvID, "error", err)
+			return "Failed to update the conversation"
+		}
+	}
+	session.Sampling = sampling
+	bot.SetSession(userID, session)
+	return bot.Settings(userID)
+}
+
+// Settings returns the session settings as answer text
+func (bot *SynologyChatBot) Settings(userID uint) string {
+	session := bot.session(userID)
+	sampling := session.Sampling.String()
+	if sampling == "" {
+		sampling = "defaults of the system role"
+	}
+	return fmt.Sprintf("role_id: %d, locale: %q, sampling: %s", session.SystemRoleID, session.Locale, sampling)
+}
+
+// session returns the session of a user, it is created when missing
+func (bot *SynologyChatBot) session(userID uint) Session {
+	session, ok := bot.GetSession(userID)
+	if !ok {
+		bot.CreateSession(userID)
+		session, _ = bot.GetSession(userID)
+	}
+	return session
+}
+
+// ListConversations returns the latest conversations of a user as answer text
+func (bot *SynologyChatBot) ListConversations(ctx context.Context, userID uint) string {
+	convs, total, err := bot.backend.ListConversations(userContext(ctx, userID), openai.ConversationFilter{
+		ListOptions: openai.ListOptions{Limit: 10, Sort: "-updated_at"},
+	})
+	if err != nil {
+		logging.Error(ctx, "list conversations", "user_id", userID, "error", err)
+		return "Failed to list conversations"
+	}
+	if total == 0 {
+		return "No conversations"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Latest %d of %d conversations:\n", len(convs), total)
+	for _, conv := range convs {
+		fmt.Fprintf(&b, "[conv_id: %d] %s (%s)\n", conv.ID, conv.Name, conv.UpdatedAt.Format("2006-01-02 15:04"))
+	}
+	return b.String()
+}
+
+// SwitchConversation continues an earlier conversation of the user, args is the conversation id
+func (bot *SynologyChatBot) SwitchConversation(ctx context.Context, userID uint, args []string) string {
+	if len(args) != 1 {
+		return "Usage: /botconf switch_conversation <conv_id>"
+	}
+	convID, err := strconv.ParseUint(args[0], 10, 64)
+	if err != nil {
+		return "Usage: /botconf switch_conversation <conv_id>"
+	}
+	conv, err := bot.backend.GetConversation(userContext(ctx, userID), uint(convID))
+	if err != nil {
+		logging.Warn(ctx, "get conversation", "conv_id", convID, "error", err)
+		return fmt.Sprintf("Conversation %d not found", convID)
+	}
+	session, ok := bot.GetSession(userID)
+	if !ok {
+		bot.CreateSession(userID)
+		session, _ = bot.GetSession(userID)
+	}
+	session.ConvID = conv.ID
+	session.EnableContext = true
+	bot.SetSession(userID, session)
+	return fmt.Sprintf("Switched to conversation %d, context enabled", conv.ID)
+}
+
 // CreateSession creates a new session for a user and adds it to the sessions map. It is called when a user starts a new conversation with the bot.
 func (bot *SynologyChatBot) CreateSession(userID uint) {
 	session := Session{
@@ -198,8 +423,11 @@ func (bot *SynologyChatBot) payloadEncode(input string) []string {
 	return res
 }
 
-// SimpleAnswer replay text to user
-func (bot *SynologyChatBot) SimpleAnswer(userIds []uint, text string) error {
+// SimpleAnswer replay text to user, ctx carries the correlation id of the incoming message
+func (bot *SynologyChatBot) SimpleAnswer(ctx context.Context, userIds []uint, text string) (err error) {
+	defer func() {
+		metrics.Delivery(err)
+	}()
 	baseURL := bot.nasDomain + "/webapi/entry.cgi"
 	queryParams := url.Values{}
 	queryParams.Set("api", "SYNO.Chat.External")
@@ -227,7 +455,8 @@ func (bot *SynologyChatBot) SimpleAnswer(userIds []uint, text string) error {
 		Success bool `json:"success"`
 	}
 
-	for _, encoded := range bot.payloadEncode(text) {
+	parts := bot.payloadEncode(text)
+	for i, encoded := range parts {
 		if len(encoded) == 0 {
 			continue
 		}
@@ -237,41 +466,36 @@ func (bot *SynologyChatBot) SimpleAnswer(userIds []uint, text string) error {
 		}
 		body, _ := json.Marshal(payload)
 		body = append([]byte("payload="), body...)
-		log.Print(string(body))
+		logging.Debug(ctx, "deliver answer", "user_ids", userIds, "part", i+1, "parts", len(parts),
+			"text", logging.Content(encoded))
 
-		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		callCtx, cancel := context.WithTimeout(ctx, 10*time.Second)
 		defer cancel()
-		req, _ := http.NewRequestWithContext(ctx, "POST", uri, bytes.NewReader(body))
+		req, _ := http.NewRequestWithContext(callCtx, "POST", uri, bytes.NewReader(body))
 		req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 		resp, err := http.DefaultClient.Do(req)
 		if err != nil {
-			log.Print(err)
+			logging.Error(ctx, "deliver answer", "user_ids", userIds, "error", err)
 			return err
 		}
 		defer resp.Body.Close()
-		log.Print(resp.Status)
 		synChatResponse := SynChatResponse{}
 		body, _ = ioutil.ReadAll(resp.Body)
-		fmt.Println(string(body))
 		if err := json.Unmarshal(body, &synChatResponse); err != nil {
-			log.Print(err)
+			logging.Error(ctx, "decode synology response", "status", resp.StatusCode, "error", err)
 			return err
 		}
-		fmt.Println(synChatResponse)
 		if !synChatResponse.Success {
-			err := fmt.Errorf("error: %v", synChatResponse)
-			log.Print(err)
+			err := fmt.Errorf("synology chat error %d: %s", synChatResponse.Data.Error.Code, synChatResponse.Data.Error.Errors)
+			logging.Error(ctx, "deliver answer", "user_ids", userIds, "status", resp.StatusCode,
+				"code", synChatResponse.Data.Error.Code, "error", err)
 			return err
 		}
+		logging.Debug(ctx, "answer delivered", "user_ids", userIds, "part", i+1, "status", resp.StatusCode)
 	}
 	return nil
 }
 
-func (bot *SynologyChatBot) price(tokenNum int) float64 {
-	price := 0.002
-	return float64(tokenNum) * price / 1000
-}
-
 func (bot *SynologyChatBot) prefix(userID uint, answer openai.ChatCompletionMessage) string {
 	session, bool := bot.GetSession(userID)
 	if !bool {
@@ -282,16 +506,24 @@ func (bot *SynologyChatBot) prefix(userID uint, answer openai.ChatCompletionMess
 		contextFlag = "enable"
 	}
 	total := answer.PromptTokens + answer.CompletionTokens
-	prefix := fmt.Sprintf("[conv_id: %d, token: %d, cost: $%f, context: %s]\n",
-		answer.ConversationID, total, bot.price(total), contextFlag)
+	truncated := ""
+	if answer.FinishReason == "length" {
+		truncated = ", truncated: reached token limit"
+	}
+	cached := ""
+	if answer.Cached {
+		cached = ", cached"
+	}
+	prefix := fmt.Sprintf("[conv_id: %d, token: %d, cost: $%f, context: %s%s%s]\n",
+		answer.ConversationID, total, openai.Cost(answer), contextFlag, truncated, cached)
 	return prefix
 }
 
 // Answer make a http request to bot's ingoing url, payload is ChatComplationMessage
-func (bot *SynologyChatBot) Answer(userIds []uint, answer openai.ChatCompletionMessage) error {
+func (bot *SynologyChatBot) Answer(ctx context.Context, userIds []uint, answer openai.ChatCompletionMessage) error {
 	prefix := bot.prefix(userIds[0], answer)
 	answer.Content = prefix + answer.Content
-	return bot.SimpleAnswer(userIds, answer.Content)
+	return bot.SimpleAnswer(ctx, userIds, answer.Content)
 }
 
 func (bot *SynologyChatBot) Run(address, port string) {
@@ -304,33 +536,64 @@ func (bot *SynologyChatBot) Run(address, port string) {
 		Timestamp string `form:"timestamp"`
 		Text      string `form:"text"`
 	}
+	bot.router.GET("/metrics", metrics.Handler())
+	bot.readiness.Register(bot.router)
 	bot.router.POST("/", func(c *gin.Context) {
 		var requestBody SynChatRequest
 		err := c.Bind(&requestBody)
 		if err != nil {
-			fmt.Println(err)
+			logging.Warn(c.Request.Context(), "bind message", "error", err)
 			c.Status(http.StatusBadRequest)
 			return
 		}
 		c.Status(http.StatusOK)
+		// the answer is sent after the webhook returned, only the correlation id is kept
+		ctx := logging.Detach(c.Request.Context())
+		logging.Info(ctx, "message received", "user_id", requestBody.UserID, "post_id", requestBody.PostID,
+			"text", logging.Content(requestBody.Text))
+		metrics.QueueDepth.Inc()
 		go func() {
+			defer metrics.QueueDepth.Dec()
 			session, ok := bot.GetSession(requestBody.UserID)
 			if !ok {
 				bot.CreateSession(requestBody.UserID)
 				session, _ = bot.GetSession(requestBody.UserID)
 			}
-			answer, err := bot.backend.Send(session.ConvID, requestBody.Text)
+			ctx := templateContext(ctx, session, requestBody.Username)
+			convID := session.ConvID
+			if convID == 0 {
+				// Send starts conversations without system role and sampling settings
+				conv := openai.Conversation{
+					Name:         uuid.NewString(),
+					SystemRoleID: session.SystemRoleID,
+					Sampling:     session.Sampling,
+				}
+				if err := bot.backend.AddConversation(ctx, &conv); err != nil {
+					logging.Error(ctx, "add conversation", "user_id", requestBody.UserID, "error", err)
+					return
+				}
+				convID = conv.ID
+			}
+			answer, err := bot.backend.Send(ctx, convID, requestBody.Text)
+			var policyErr *openai.PolicyError
+			if errors.As(err, &policyErr) {
+				bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, policyErr.Notice)
+				return
+			}
+			if errors.Is(err, openai.ErrPromptTooLong) {
+				bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, "Your message is too long, please shorten it")
+				return
+			}
 			if err != nil {
-				log.Print(err)
+				logging.Error(ctx, "send message", "user_id", requestBody.UserID, "conv_id", convID, "error", err)
 				return
 			}
 			if session.ConvID == 0 && session.EnableContext {
 				session.ConvID = answer.ConversationID
 				bot.SetSession(requestBody.UserID, session)
 			}
-			err = bot.Answer([]uint{requestBody.UserID}, answer)
-			if err != nil {
-				log.Print(err)
+			if err := bot.Answer(ctx, []uint{requestBody.UserID}, answer); err != nil {
+				// SimpleAnswer logged the failure
 				return
 			}
 		}()
@@ -346,22 +609,46 @@ func (bot *SynologyChatBot) Run(address, port string) {
 		var requestBody RequestBody
 		err := c.Bind(&requestBody)
 		if err != nil {
-			fmt.Println(err)
+			logging.Warn(c.Request.Context(), "bind command", "error", err)
 			c.Status(http.StatusBadRequest)
 			return
 		}
+		ctx := logging.Detach(c.Request.Context())
 		command := strings.TrimPrefix(requestBody.Text, "/botconf ")
-		log.Printf("command: %s", command)
-		switch command {
+		args := strings.Fields(command)
+		if len(args) == 0 {
+			c.Status(http.StatusOK)
+			return
+		}
+		// arguments may hold personal values, e.g. template fields
+		logging.Info(ctx, "command received", "user_id", requestBody.UserID, "command", args[0],
+			"text", logging.Content(command))
+		switch args[0] {
 		case "disable_context":
 			bot.DisableContext(requestBody.UserID)
-			bot.SimpleAnswer([]uint{requestBody.UserID}, "Context disabled")
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, "Context disabled")
 		case "enable_context":
 			bot.EnableContext(requestBody.UserID)
-			bot.SimpleAnswer([]uint{requestBody.UserID}, "Context enabled")
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, "Context enabled")
 		case "reset_conversation":
 			bot.ResetConversation(requestBody.UserID)
-			bot.SimpleAnswer([]uint{requestBody.UserID}, "Conversation Reseted")
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, "Conversation Reseted")
+		case "conversations":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.ListConversations(ctx, requestBody.UserID))
+		case "switch_conversation":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.SwitchConversation(ctx, requestBody.UserID, args[1:]))
+		case "roles":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.ListSystemRoles(ctx))
+		case "role":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.SetSystemRole(ctx, requestBody.UserID, args[1:]))
+		case "locale":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.SetLocale(requestBody.UserID, args[1:]))
+		case "field":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.SetField(requestBody.UserID, args[1:]))
+		case "set":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.SetSampling(ctx, requestBody.UserID, args[1:]))
+		case "settings":
+			bot.SimpleAnswer(ctx, []uint{requestBody.UserID}, bot.Settings(requestBody.UserID))
 		default:
 			// do nothing
 		}
@@ -370,57 +657,213 @@ func (bot *SynologyChatBot) Run(address, port string) {
 
 	err := bot.router.Run(fmt.Sprintf("%s:%s", address, port))
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(context.Background(), "run bot", "error", err)
 	}
 }
 
 type Config struct {
-	SqlitePath  string `mapstructure:"sqlite_path,omitempty"`
-	OpenaiToken string `mapstructure:"openai_token"`
-	BotToken    string `mapstructure:"bot_token"`
-	NasDomain   string `mapstructure:"nas_domain"`
-	Address     string `mapstructure:"service_address,omitempty"`
-	Port        string `mapstructure:"service_port,omitempty"`
-	//DatabaseUrl string `mapstructure:"database_url"`
+	// SqlitePath is the sqlite file, it is used when Database is not configured
+	SqlitePath string         `mapstructure:"sqlite_path,omitempty"`
+	Database   storage.Config `mapstructure:"database,omitempty"`
+	// EncryptionKeyFile enables encryption of message and system role content
+	EncryptionKeyFile string           `mapstructure:"encryption_key_file,omitempty"`
+	OpenaiToken       string           `mapstructure:"openai_token"`
+	BotToken          string           `mapstructure:"bot_token"`
+	NasDomain         string           `mapstructure:"nas_domain"`
+	Address           string           `mapstructure:"service_address,omitempty"`
+	Port              string           `mapstructure:"service_port,omitempty"`
+	Redaction         config.Redaction `mapstructure:"redaction,omitempty"`
+	// ResponseCacheTTL enables the response cache of context-free prompts, e.g. "24h"
+	ResponseCacheTTL time.Duration        `mapstructure:"response_cache_ttl,omitempty"`
+	SemanticCache    config.SemanticCache `mapstructure:"semantic_cache,omitempty"`
+	Log              config.Log           `mapstructure:"log,omitempty"`
+	Readiness        config.Readiness     `mapstructure:"readiness,omitempty"`
 }
 
 func initConfig(confPath string) Config {
-	// Set the Viper package to read config.yaml.
-	viper.SetConfigFile(confPath)
-	// Read in the config file.
-	err := viper.ReadInConfig()
-	if err != nil {
-		log.Fatal(fmt.Errorf("fatal error config file: %s", err))
+	if err := config.Read(confPath); err != nil {
+		logging.Fatal(context.Background(), "read config file", "path", confPath, "error", err)
 	}
 	viper.BindPFlag("sqlite_path", pflag.Lookup("sqlite_path"))
 	viper.BindPFlag("openai_token", pflag.Lookup("openai_token"))
 	viper.BindPFlag("bot_token", pflag.Lookup("bot_token"))
 	// Initialize the Config struct.
-	var config Config
+	var conf Config
 	// Unmarshal the config file into the Config struct.
-	err = viper.Unmarshal(&config)
+	if err := viper.Unmarshal(&conf); err != nil {
+		logging.Fatal(context.Background(), "unmarshal config", "error", err)
+	}
+	return conf
+}
+
+// backfillOwners assigns conversations without owner that are referenced by a bot session
+// to the Synology user of the session, usage: cli migrate backfill-owners [sessions.gob]
+func backfillOwners(db *gorm.DB, sessionsPath string) error {
+	if err := migrations.Up(context.Background(), db); err != nil {
+		return err
+	}
+	if sessionsPath == "" {
+		sessionsPath = "sessions.gob"
+	}
+	bot := &SynologyChatBot{}
+	if err := bot.LoadSessions(sessionsPath); err != nil {
+		return err
+	}
+	var err error
+	var count int64
+	bot.sessions.Range(func(k, v interface{}) bool {
+		session := v.(Session)
+		if session.ConvID == 0 {
+			return true
+		}
+		res := db.Model(&openai.Conversation{}).Where("id = ? AND owner = ?", session.ConvID, "").
+			Update("owner", synologyOwner(session.UserID))
+		if err = res.Error; err != nil {
+			return false
+		}
+		count += res.RowsAffected
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	logging.Info(context.Background(), "owners assigned", "conversations", count)
+	return nil
+}
+
+// importChatGPT imports conversations.json of a ChatGPT data export for a Synology Chat user,
+// usage: cli import conversations.json [synology user id]
+func importChatGPT(store openai.Store, path, userID string) error {
+	if path == "" {
+		return fmt.Errorf("usage: %s import <conversations.json> [synology user id]", os.Args[0])
+	}
+	// conversations imported without user have no owner
+	ctx := openai.SystemContext(context.Background())
+	if userID != "" {
+		id, err := strconv.ParseUint(userID, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid synology user id %q", userID)
+		}
+		ctx = userContext(ctx, uint(id))
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	res, err := openai.ImportChatGPTExport(ctx, store, file)
 	if err != nil {
-		log.Fatal(fmt.Errorf("error unmarshalling config: %s", err))
+		return err
 	}
-	return config
+	logging.Info(ctx, "import done", "conversations", res.Conversations, "messages", res.Messages,
+		"unchanged", res.Skipped)
+	return nil
 }
 
 func main() {
-	var config Config
-	confPath := *pflag.StringP("conf", "c", "config.yaml", "configure file path")
-	//confPath := *flag.String("conf", "config.yaml", "config file path")
+	// lines of the standard log package, e.g. of dependencies, become info lines
+	stdlog.SetFlags(0)
+	stdlog.SetOutput(logging.Writer(logging.LevelInfo))
+	ctx := context.Background()
+	var conf Config
+	confPath := pflag.StringP("conf", "c", "config.yaml", "configure file path")
 	pflag.String("sqlite_path", "", "sqlite file path")
 	pflag.String("openai_token", "", "openai token")
 	pflag.String("bot_token", "", "synology chat bot token")
 	pflag.Parse()
-	config = initConfig(confPath)
-	fmt.Println(config)
-	db, err := initDB(config.SqlitePath)
+	// keygen [key id] prints a new line for the encryption key file
+	if pflag.Arg(0) == "keygen" {
+		id := pflag.Arg(1)
+		if id == "" {
+			id = time.Now().Format("20060102")
+		}
+		key, err := encryption.GenerateKey(id)
+		if err != nil {
+			logging.Fatal(ctx, "generate key", "error", err)
+		}
+		fmt.Println(key)
+		return
+	}
+	conf = initConfig(*confPath)
+	if err := conf.Log.Apply(conf.Redaction); err != nil {
+		logging.Fatal(ctx, "log config", "error", err)
+	}
+	logging.Info(ctx, "config loaded", "path", *confPath, "level", logging.GetLevel(), "content", logging.GetContentMode())
+	if conf.Database.Driver == "" && conf.Database.DSN == "" {
+		conf.Database = storage.Config{Driver: storage.DriverSqlite, DSN: conf.SqlitePath}
+	}
+	if pflag.Arg(0) == "migrate" {
+		db, err := storage.Open(conf.Database)
+		if err == nil && pflag.Arg(1) == "backfill-owners" {
+			err = backfillOwners(db, pflag.Arg(2))
+		} else if err == nil {
+			err = migrations.Command(context.Background(), db, pflag.Args()[1:], os.Stdout)
+		}
+		if err != nil {
+			logging.Fatal(ctx, "migrate", "error", err)
+		}
+		return
+	}
+	db, err := initDB(conf.Database)
 	if err != nil {
-		log.Fatal(err)
+		logging.Fatal(ctx, "init database", "error", err)
+	}
+	var storeOpts []openai.StoreOption
+	if conf.EncryptionKeyFile != "" {
+		keyring, err := encryption.LoadKeyring(conf.EncryptionKeyFile)
+		if err != nil {
+			logging.Fatal(ctx, "load encryption keys", "error", err)
+		}
+		storeOpts = append(storeOpts, openai.WithKeyring(keyring))
+	}
+	store := openai.NewGormStore(db, storeOpts...)
+	if pflag.Arg(0) == "reencrypt" {
+		n, err := store.Reencrypt(ctx)
+		if err != nil {
+			logging.Fatal(ctx, "re-encrypt", "error", err)
+		}
+		logging.Info(ctx, "re-encrypted", "rows", n)
+		return
+	}
+	var backendOpts []openai.Option
+	if conf.Redaction.Enabled {
+		redactor, err := openai.NewRedactor(conf.Redaction.Rules)
+		if err != nil {
+			logging.Fatal(ctx, "redaction rules", "error", err)
+		}
+		backendOpts = append(backendOpts, openai.WithRedactor(redactor))
+	}
+	if conf.ResponseCacheTTL > 0 {
+		backendOpts = append(backendOpts, openai.WithResponseCache(store, conf.ResponseCacheTTL))
+	}
+	if conf.SemanticCache.TTL > 0 {
+		if conf.SemanticCache.Embedder == "" {
+			conf.SemanticCache.Embedder = "openai"
+		}
+		if conf.SemanticCache.Threshold == 0 {
+			conf.SemanticCache.Threshold = 0.95
+		}
+		embedder, err := openai.NewEmbedder(conf.SemanticCache.Embedder, conf.OpenaiToken)
+		if err != nil {
+			logging.Fatal(ctx, "semantic cache embedder", "error", err)
+		}
+		backendOpts = append(backendOpts, openai.WithSemanticCache(store, embedder, conf.SemanticCache.TTL, conf.SemanticCache.Threshold))
+	}
+	backend := openai.NewGpt3p5(store, conf.OpenaiToken, backendOpts...)
+	if pflag.Arg(0) == "import" {
+		if err := importChatGPT(backend, pflag.Arg(1), pflag.Arg(2)); err != nil {
+			logging.Fatal(ctx, "import", "error", err)
+		}
+		return
+	}
+	config.WatchLog()
+	app := NewSynologyChatBot(metrics.Instrument(backend), conf.BotToken, conf.NasDomain)
+	app.readiness.Add("database", func(ctx context.Context) error {
+		return storage.Ping(ctx, db)
+	})
+	if conf.Readiness.OpenAI {
+		app.readiness.AddCached("openai", backend.Ping, conf.Readiness.OpenAITTL)
 	}
-	backend := openai.NewGpt3p5(db, config.OpenaiToken)
-	app := NewSynologyChatBot(backend, config.BotToken, config.NasDomain)
 	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
@@ -428,5 +871,5 @@ func main() {
 		app.DumpSessions("sessions.gob")
 		os.Exit(0)
 	}()
-	app.Run(config.Address, config.Port)
+	app.Run(conf.Address, conf.Port)
 }
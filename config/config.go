@@ -0,0 +1,103 @@
+// Package config holds the configuration sections shared by the bot and the api server. Both
+// read a YAML file with viper, flags override the values of the file.
+package config
+
+import (
+	"context"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/openai"
+	"github.com/fsnotify/fsnotify"
+	"github.com/spf13/viper"
+)
+
+// Read reads the config file at path into viper and sets the defaults of the shared sections.
+// An empty path reads no file, the values then come from flags and defaults.
+func Read(path string) error {
+	viper.SetDefault("readiness.openai", true)
+	viper.SetDefault("readiness.openai_ttl", time.Minute)
+	viper.SetDefault("log.level", "info")
+	viper.SetDefault("log.content", "omit")
+	if path == "" {
+		return nil
+	}
+	viper.SetConfigFile(path)
+	return viper.ReadInConfig()
+}
+
+// Readiness configures the checks of /readyz, the OpenAI check is on by default and its
+// result is reused for OpenAITTL
+type Readiness struct {
+	OpenAI    bool          `mapstructure:"openai"`
+	OpenAITTL time.Duration `mapstructure:"openai_ttl"`
+}
+
+// Log sets the log level, "debug", "info", "warn" or "error", and how message content is
+// logged, "omit", "redact" or "full". Both are reloaded when the config file changes.
+type Log struct {
+	Level   string `mapstructure:"level"`
+	Content string `mapstructure:"content"`
+}
+
+// Apply sets the log level and the content mode, content is redacted with the redaction rules
+// of the prompts
+func (cfg Log) Apply(redaction Redaction) error {
+	level, err := logging.ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+	mode, err := logging.ParseContentMode(cfg.Content)
+	if err != nil {
+		return err
+	}
+	if mode == logging.ContentRedact {
+		redactor, err := openai.NewRedactor(redaction.Rules)
+		if err != nil {
+			return err
+		}
+		logging.SetContentRedactor(redactor.Redact)
+	}
+	logging.SetLevel(level)
+	logging.SetContentMode(mode)
+	return nil
+}
+
+// SemanticCache enables the semantic cache when TTL is set, Embedder is "openai" or "hash"
+type SemanticCache struct {
+	TTL       time.Duration `mapstructure:"ttl"`
+	Threshold float32       `mapstructure:"threshold"`
+	Embedder  string        `mapstructure:"embedder"`
+}
+
+// Redaction configures the redaction of prompts, Rules default to openai.DefaultRedactionRules
+type Redaction struct {
+	Enabled bool                   `mapstructure:"enabled"`
+	Rules   []openai.RedactionRule `mapstructure:"rules,omitempty"`
+}
+
+// WatchLog applies the log section of the config file whenever the file changes
+func WatchLog() {
+	if viper.ConfigFileUsed() == "" {
+		return
+	}
+	viper.OnConfigChange(func(e fsnotify.Event) {
+		var log Log
+		var redaction Redaction
+		if err := viper.UnmarshalKey("log", &log); err != nil {
+			logging.Error(context.Background(), "reload config", "error", err)
+			return
+		}
+		if err := viper.UnmarshalKey("redaction", &redaction); err != nil {
+			logging.Error(context.Background(), "reload config", "error", err)
+			return
+		}
+		if err := log.Apply(redaction); err != nil {
+			logging.Error(context.Background(), "reload log config", "error", err)
+			return
+		}
+		logging.Info(context.Background(), "log config reloaded", "level", logging.GetLevel(),
+			"content", logging.GetContentMode())
+	})
+	viper.WatchConfig()
+}
@@ -0,0 +1,190 @@
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/fsnotify/fsnotify"
+)
+
+// Server configures the listener of an HTTP server
+type Server struct {
+	// Address is the listen address, default ":443" with TLS and ":8080" without
+	Address string `mapstructure:"address"`
+	// TrustedProxies are the addresses or CIDRs of reverse proxies whose X-Forwarded-For is
+	// trusted for the client IP, all proxies are trusted when it is empty
+	TrustedProxies []string `mapstructure:"trusted_proxies"`
+	TLS            TLS      `mapstructure:"tls"`
+}
+
+// TLS configures HTTPS. Certificates are reloaded when the files change, so renewed
+// certificates apply without restart.
+type TLS struct {
+	// Enabled is false for plain HTTP, e.g. behind a TLS terminating reverse proxy
+	Enabled  bool   `mapstructure:"enabled"`
+	CertFile string `mapstructure:"cert_file"`
+	KeyFile  string `mapstructure:"key_file"`
+	// MinVersion is "1.0", "1.1", "1.2" or "1.3", default "1.2"
+	MinVersion string `mapstructure:"min_version"`
+	// CipherSuites are the names of the cipher suites of TLS 1.0 to 1.2, e.g.
+	// "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", default are the secure suites of Go. The suites
+	// of TLS 1.3 are not configurable.
+	CipherSuites []string `mapstructure:"cipher_suites"`
+}
+
+// ListenAddress returns Address or the default address
+func (s Server) ListenAddress() string {
+	switch {
+	case s.Address != "":
+		return s.Address
+	case s.TLS.Enabled:
+		return ":443"
+	default:
+		return ":8080"
+	}
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Config returns the tls.Config of cfg, its certificate is loaded now and reloaded whenever the
+// certificate or the key file changes until ctx is done
+func (cfg TLS) Config(ctx context.Context) (*tls.Config, error) {
+	minVersion := cfg.MinVersion
+	if minVersion == "" {
+		minVersion = "1.2"
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("unknown tls min_version %q, expect 1.0, 1.1, 1.2 or 1.3", cfg.MinVersion)
+	}
+	suites, err := cipherSuites(cfg.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	r := &certReloader{certFile: cfg.CertFile, keyFile: cfg.KeyFile}
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	if err := r.watch(ctx); err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		MinVersion:     version,
+		CipherSuites:   suites,
+		GetCertificate: r.getCertificate,
+	}, nil
+}
+
+// cipherSuites looks up the ids of names, insecure suites are refused
+func cipherSuites(names []string) ([]uint16, error) {
+	if len(names) == 0 {
+		return nil, nil
+	}
+	secure := make(map[string]uint16)
+	for _, s := range tls.CipherSuites() {
+		secure[s.Name] = s.ID
+	}
+	ids := make([]uint16, 0, len(names))
+	for _, name := range names {
+		id, ok := secure[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure tls cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// certReloader serves the certificate of the files it was last loaded from
+type certReloader struct {
+	certFile, keyFile string
+
+	mu   sync.RWMutex
+	cert *tls.Certificate
+}
+
+func (r *certReloader) load() error {
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("load tls certificate: %w", err)
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+// watch reloads the certificate on changes of the directories of the files, renewals often
+// replace the files or swap symlinks instead of writing them. A failed reload keeps the
+// current certificate.
+func (r *certReloader) watch(ctx context.Context) error {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	dirs := map[string]bool{filepath.Dir(r.certFile): true, filepath.Dir(r.keyFile): true}
+	for dir := range dirs {
+		if err := w.Add(dir); err != nil {
+			w.Close()
+			return err
+		}
+	}
+	go func() {
+		defer w.Close()
+		// renewals write several files, reload once they are done
+		var reload <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case e, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if e.Op != fsnotify.Chmod && r.affects(e.Name) {
+					reload = time.After(time.Second)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logging.Warn(ctx, "watch tls certificate", "error", err)
+			case <-reload:
+				reload = nil
+				if err := r.load(); err != nil {
+					logging.Error(ctx, "reload tls certificate", "cert_file", r.certFile, "error", err)
+					continue
+				}
+				logging.Info(ctx, "tls certificate reloaded", "cert_file", r.certFile)
+			}
+		}
+	}()
+	return nil
+}
+
+// affects reports whether a change of name may change the certificate or the key, names of
+// other files in their directories count when the files are symlinks, e.g. of Kubernetes secrets
+func (r *certReloader) affects(name string) bool {
+	name = filepath.Clean(name)
+	if name == filepath.Clean(r.certFile) || name == filepath.Clean(r.keyFile) {
+		return true
+	}
+	return strings.HasPrefix(filepath.Base(name), "..")
+}
@@ -0,0 +1,156 @@
+// Package encryption encrypts database fields with AES-256-GCM.
+//
+// Keys are read from a key file with one "<key id>:<base64 encoded 32 byte key>" per line,
+// blank lines and lines starting with # are ignored. The first key is the primary key and
+// encrypts new values, the other keys are only used to decrypt. To rotate keys, put a new
+// key in the first line, re-encrypt the database and remove the old key afterwards.
+package encryption
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// prefix marks encrypted values, the full format is "enc:v1:<key id>:<base64(nonce|ciphertext)>"
+const prefix = "enc:v1:"
+
+var (
+	// ErrUnknownKey is returned when a value is encrypted with a key missing in the keyring
+	ErrUnknownKey = errors.New("encryption key not in keyring")
+	// ErrMalformed is returned for values with the encryption prefix that can not be parsed
+	ErrMalformed = errors.New("malformed encrypted value")
+)
+
+// Keyring holds the keys of a key file
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyring reads a key file
+func LoadKeyring(path string) (*Keyring, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return ParseKeyring(file)
+}
+
+// ParseKeyring reads keys in key file format from r
+func ParseKeyring(r io.Reader) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, encoded, ok := strings.Cut(line, ":")
+		if !ok || id == "" {
+			return nil, fmt.Errorf("key file line %d: expect <key id>:<base64 key>", n)
+		}
+		if _, dup := k.keys[id]; dup {
+			return nil, fmt.Errorf("key file line %d: duplicate key id %q", n, id)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("key file line %d: key must be 32 bytes encoded in base64", n)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[id] = aead
+		if k.primary == "" {
+			k.primary = id
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if k.primary == "" {
+		return nil, fmt.Errorf("key file has no key")
+	}
+	return k, nil
+}
+
+// GenerateKey returns a new random key line in key file format
+func GenerateKey(id string) (string, error) {
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return "", err
+	}
+	return id + ":" + base64.StdEncoding.EncodeToString(key), nil
+}
+
+// Encrypt encrypts plaintext with the primary key, the empty string stays empty
+func (k *Keyring) Encrypt(plaintext string) (string, error) {
+	if plaintext == "" {
+		return "", nil
+	}
+	aead := k.keys[k.primary]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	// the key id is authenticated, so a value can not be moved to another key id
+	sealed := aead.Seal(nonce, nonce, []byte(plaintext), []byte(k.primary))
+	return prefix + k.primary + ":" + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt decrypts a value returned by Encrypt. Values without the encryption prefix are
+// returned unchanged, so databases written before encryption was enabled stay readable.
+func (k *Keyring) Decrypt(value string) (string, error) {
+	id, encoded, ok := split(value)
+	if !ok {
+		return value, nil
+	}
+	aead, ok := k.keys[id]
+	if !ok {
+		return "", fmt.Errorf("%w: %q", ErrUnknownKey, id)
+	}
+	sealed, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(sealed) < aead.NonceSize() {
+		return "", ErrMalformed
+	}
+	plaintext, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(id))
+	if err != nil {
+		return "", fmt.Errorf("decrypt with key %q: %w", id, err)
+	}
+	return string(plaintext), nil
+}
+
+// NeedsReencrypt reports whether value is plaintext or encrypted with a key other than the primary key
+func (k *Keyring) NeedsReencrypt(value string) bool {
+	if value == "" {
+		return false
+	}
+	id, _, ok := split(value)
+	return !ok || id != k.primary
+}
+
+// Encrypted reports whether value has the encryption prefix
+func Encrypted(value string) bool {
+	_, _, ok := split(value)
+	return ok
+}
+
+func split(value string) (id, encoded string, ok bool) {
+	if !strings.HasPrefix(value, prefix) {
+		return "", "", false
+	}
+	return strings.Cut(strings.TrimPrefix(value, prefix), ":")
+}
@@ -0,0 +1,145 @@
+// Package health serves the liveness and readiness endpoints of the bot and the api server.
+// /healthz only reports that the process serves requests, /readyz runs the registered checks
+// of the dependencies and answers 503 when one of them fails.
+package health
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/gin-gonic/gin"
+)
+
+// Check reports whether a dependency is usable, nil means ready
+type Check func(ctx context.Context) error
+
+// checkTimeout bounds every check of a readiness request
+const checkTimeout = 5 * time.Second
+
+// Status is the result of one check
+type Status struct {
+	Status     string `json:"status" example:"ok"`
+	Error      string `json:"error,omitempty"`
+	DurationMs int64  `json:"duration_ms"`
+	// Cached is true when the result of an earlier run was reused, see Cached
+	Cached    bool      `json:"cached,omitempty"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+// Report is the body of /readyz
+type Report struct {
+	// Status is "ok" when all checks passed and "unavailable" otherwise
+	Status string            `json:"status" example:"ok"`
+	Checks map[string]Status `json:"checks"`
+}
+
+// Checker runs the readiness checks
+type Checker struct {
+	mu     sync.Mutex
+	names  []string
+	checks map[string]*cachedCheck
+}
+
+type cachedCheck struct {
+	check Check
+	ttl   time.Duration
+
+	mu   sync.Mutex
+	last Status
+}
+
+// New returns a checker without checks
+func New() *Checker {
+	return &Checker{checks: make(map[string]*cachedCheck)}
+}
+
+// Add registers check under name, it runs on every readiness request
+func (h *Checker) Add(name string, check Check) {
+	h.AddCached(name, check, 0)
+}
+
+// AddCached registers check under name, its result is reused for ttl, so that frequent probes
+// do not hammer slow or rate limited dependencies
+func (h *Checker) AddCached(name string, check Check, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.checks[name]; !ok {
+		h.names = append(h.names, name)
+	}
+	h.checks[name] = &cachedCheck{check: check, ttl: ttl}
+}
+
+// Run runs all checks concurrently
+func (h *Checker) Run(ctx context.Context) Report {
+	h.mu.Lock()
+	names := append([]string(nil), h.names...)
+	checks := make([]*cachedCheck, len(names))
+	for i, name := range names {
+		checks[i] = h.checks[name]
+	}
+	h.mu.Unlock()
+
+	statuses := make([]Status, len(names))
+	var wg sync.WaitGroup
+	for i := range checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			statuses[i] = checks[i].run(ctx)
+		}(i)
+	}
+	wg.Wait()
+
+	report := Report{Status: "ok", Checks: make(map[string]Status, len(names))}
+	for i, name := range names {
+		report.Checks[name] = statuses[i]
+		if statuses[i].Status != "ok" {
+			report.Status = "unavailable"
+			logging.Warn(ctx, "readiness check failed", "check", name, "error", statuses[i].Error)
+		}
+	}
+	return report
+}
+
+func (c *cachedCheck) run(ctx context.Context) Status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.ttl > 0 && !c.last.CheckedAt.IsZero() && time.Since(c.last.CheckedAt) < c.ttl {
+		s := c.last
+		s.Cached = true
+		return s
+	}
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+	start := time.Now()
+	err := c.check(ctx)
+	c.last = Status{Status: "ok", DurationMs: time.Since(start).Milliseconds(), CheckedAt: start}
+	if err != nil {
+		c.last.Status, c.last.Error = "error", err.Error()
+	}
+	return c.last
+}
+
+// Healthz answers 200 while the process serves requests
+func Healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// Readyz runs the checks and answers 200 when all passed and 503 otherwise
+func (h *Checker) Readyz(c *gin.Context) {
+	report := h.Run(c.Request.Context())
+	code := http.StatusOK
+	if report.Status != "ok" {
+		code = http.StatusServiceUnavailable
+	}
+	c.JSON(code, report)
+}
+
+// Register adds GET /healthz and GET /readyz to r
+func (h *Checker) Register(r gin.IRoutes) {
+	r.GET("/healthz", Healthz)
+	r.GET("/readyz", h.Readyz)
+}
@@ -0,0 +1,67 @@
+package logging
+
+import (
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CorrelationHeader carries the correlation id of a request, a valid incoming value is kept
+// so callers can correlate their own logs
+const CorrelationHeader = "X-Request-Id"
+
+// Middleware assigns a correlation id to every request of the gin router of server, e.g.
+// "api" or "bot", and logs the request when it is done. Scrapes of /metrics and probes of
+// /healthz and /readyz are logged at debug level.
+func Middleware(server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(CorrelationHeader)
+		if !validCorrelationID(id) {
+			id = NewCorrelationID()
+		}
+		c.Header(CorrelationHeader, id)
+		c.Request = c.Request.WithContext(WithCorrelationID(c.Request.Context(), id))
+		c.Next()
+
+		status := c.Writer.Status()
+		l := LevelInfo
+		switch {
+		case status >= 500:
+			l = LevelError
+		case status >= 400:
+			l = LevelWarn
+		case probes[c.FullPath()]:
+			l = LevelDebug
+		}
+		kv := []interface{}{
+			"server", server,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"route", c.FullPath(),
+			"status", status,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		if len(c.Errors) > 0 {
+			kv = append(kv, "errors", c.Errors.String())
+		}
+		Log(c.Request.Context(), l, "http request", kv...)
+	}
+}
+
+// probes are the routes polled by monitoring
+var probes = map[string]bool{"/metrics": true, "/healthz": true, "/readyz": true}
+
+// validCorrelationID accepts short ids of printable ASCII without spaces
+func validCorrelationID(id string) bool {
+	if id == "" || len(id) > 128 {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,299 @@
+// Package logging writes structured log lines as JSON objects with a level, a message, the
+// correlation id of the request being served and key value pairs. The level and the logging of
+// message content can be changed at runtime.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Level is the severity of a log line, lines below the configured level are dropped
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+func (l Level) String() string {
+	switch l {
+	case LevelDebug:
+		return "debug"
+	case LevelInfo:
+		return "info"
+	case LevelWarn:
+		return "warn"
+	case LevelError:
+		return "error"
+	}
+	return fmt.Sprintf("level(%d)", int32(l))
+}
+
+// ParseLevel parses "debug", "info", "warn" or "error"
+func ParseLevel(s string) (Level, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "debug":
+		return LevelDebug, nil
+	case "info", "":
+		return LevelInfo, nil
+	case "warn", "warning":
+		return LevelWarn, nil
+	case "error":
+		return LevelError, nil
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", s)
+}
+
+// ContentMode controls how message content passed through Content is logged
+type ContentMode int32
+
+const (
+	// ContentOmit logs only the length of the content
+	ContentOmit ContentMode = iota
+	// ContentRedact logs the content with sensitive values replaced, see SetContentRedactor
+	ContentRedact
+	// ContentFull logs the content as is
+	ContentFull
+)
+
+func (m ContentMode) String() string {
+	switch m {
+	case ContentOmit:
+		return "omit"
+	case ContentRedact:
+		return "redact"
+	case ContentFull:
+		return "full"
+	}
+	return fmt.Sprintf("content(%d)", int32(m))
+}
+
+// ParseContentMode parses "omit", "redact" or "full"
+func ParseContentMode(s string) (ContentMode, error) {
+	switch strings.ToLower(strings.TrimSpace(s)) {
+	case "omit", "":
+		return ContentOmit, nil
+	case "redact":
+		return ContentRedact, nil
+	case "full":
+		return ContentFull, nil
+	}
+	return ContentOmit, fmt.Errorf("unknown log content mode %q", s)
+}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer    = os.Stderr
+	level    int32        = int32(LevelInfo)
+	content  int32        = int32(ContentOmit)
+	redactor atomic.Value // func(string) string
+)
+
+// SetOutput sets the writer of log lines, default is stderr
+func SetOutput(w io.Writer) {
+	mu.Lock()
+	defer mu.Unlock()
+	out = w
+}
+
+// SetLevel sets the minimum level of logged lines, it is safe to call while logging
+func SetLevel(l Level) {
+	atomic.StoreInt32(&level, int32(l))
+}
+
+// GetLevel returns the minimum level of logged lines
+func GetLevel() Level {
+	return Level(atomic.LoadInt32(&level))
+}
+
+// Enabled reports whether lines of level l are logged
+func Enabled(l Level) bool {
+	return l >= GetLevel()
+}
+
+// SetContentMode sets how message content is logged, default is ContentOmit
+func SetContentMode(m ContentMode) {
+	atomic.StoreInt32(&content, int32(m))
+}
+
+// GetContentMode returns how message content is logged
+func GetContentMode() ContentMode {
+	return ContentMode(atomic.LoadInt32(&content))
+}
+
+// SetContentRedactor sets the function replacing sensitive values of content in ContentRedact mode.
+// Without redactor content is omitted in that mode.
+func SetContentRedactor(f func(string) string) {
+	redactor.Store(f)
+}
+
+// Content returns the value to log for the message content text according to the content mode
+func Content(text string) string {
+	switch GetContentMode() {
+	case ContentFull:
+		return text
+	case ContentRedact:
+		if f, ok := redactor.Load().(func(string) string); ok && f != nil {
+			return f(text)
+		}
+	}
+	return fmt.Sprintf("[%d chars]", len([]rune(text)))
+}
+
+type correlationKey struct{}
+
+// WithCorrelationID returns a context carrying the correlation id of a request, lines logged
+// with the context or a context derived from it carry the id
+func WithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationKey{}, id)
+}
+
+// CorrelationID returns the correlation id carried by ctx, "" when there is none
+func CorrelationID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(correlationKey{}).(string)
+	return id
+}
+
+// NewCorrelationID returns a new random correlation id
+func NewCorrelationID() string {
+	return uuid.NewString()
+}
+
+// Detach returns a background context carrying the correlation id of ctx, for work that
+// outlives the request of ctx
+func Detach(ctx context.Context) context.Context {
+	return WithCorrelationID(context.Background(), CorrelationID(ctx))
+}
+
+// Debug logs msg with the key value pairs kv at debug level
+func Debug(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelDebug, msg, kv)
+}
+
+// Info logs msg with the key value pairs kv at info level
+func Info(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelInfo, msg, kv)
+}
+
+// Warn logs msg with the key value pairs kv at warn level
+func Warn(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelWarn, msg, kv)
+}
+
+// Error logs msg with the key value pairs kv at error level
+func Error(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelError, msg, kv)
+}
+
+// Fatal logs msg with the key value pairs kv at error level and exits the process
+func Fatal(ctx context.Context, msg string, kv ...interface{}) {
+	write(ctx, LevelError, msg, kv)
+	os.Exit(1)
+}
+
+// Log logs msg with the key value pairs kv at level l
+func Log(ctx context.Context, l Level, msg string, kv ...interface{}) {
+	write(ctx, l, msg, kv)
+}
+
+// write encodes one line, keys of kv are strings and values anything json can encode, errors
+// and fmt.Stringers are logged as their text
+func write(ctx context.Context, l Level, msg string, kv []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+	var b bytes.Buffer
+	b.WriteString(`{"time":`)
+	writeValue(&b, time.Now().Format(time.RFC3339Nano))
+	b.WriteString(`,"level":`)
+	writeValue(&b, l.String())
+	b.WriteString(`,"msg":`)
+	writeValue(&b, msg)
+	if id := CorrelationID(ctx); id != "" {
+		b.WriteString(`,"correlation_id":`)
+		writeValue(&b, id)
+	}
+	// skip write and the exported function calling it
+	if _, file, line, ok := runtime.Caller(2); ok {
+		b.WriteString(`,"caller":`)
+		writeValue(&b, fmt.Sprintf("%s:%d", shortFile(file), line))
+	}
+	for i := 0; i < len(kv); i += 2 {
+		key, ok := kv[i].(string)
+		if !ok {
+			key = fmt.Sprint(kv[i])
+		}
+		b.WriteByte(',')
+		writeValue(&b, key)
+		b.WriteByte(':')
+		if i+1 < len(kv) {
+			writeValue(&b, kv[i+1])
+		} else {
+			b.WriteString("null")
+		}
+	}
+	b.WriteString("}\n")
+	mu.Lock()
+	defer mu.Unlock()
+	out.Write(b.Bytes())
+}
+
+func writeValue(b *bytes.Buffer, v interface{}) {
+	switch x := v.(type) {
+	case error:
+		v = x.Error()
+	case fmt.Stringer:
+		v = x.String()
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(data)
+}
+
+// shortFile returns the package directory and the file name of a source file path
+func shortFile(file string) string {
+	i := strings.LastIndexByte(file, '/')
+	if i < 0 {
+		return file
+	}
+	if j := strings.LastIndexByte(file[:i], '/'); j >= 0 {
+		return file[j+1:]
+	}
+	return file
+}
+
+// Writer returns a writer logging each written line as a message at level l, it takes over the
+// output of the standard library log package with log.SetOutput
+func Writer(l Level) io.Writer {
+	return lineWriter(l)
+}
+
+type lineWriter Level
+
+func (w lineWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			write(nil, Level(w), line, nil)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,144 @@
+// Package metrics exposes Prometheus metrics of the bot and the api server at /metrics.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/coolbit-in/alone/openai"
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+var (
+	completions = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alone_completions_total",
+		Help: "Messages sent to the backend by model and outcome: ok, error, rejected or cached.",
+	}, []string{"model", "outcome"})
+	completionDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alone_completion_duration_seconds",
+		Help:    "Latency of OpenAI completion calls by model and outcome.",
+		Buckets: []float64{0.5, 1, 2, 5, 10, 20, 30, 60},
+	}, []string{"model", "outcome"})
+	tokens = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alone_tokens_total",
+		Help: "Tokens used by model and type: prompt or completion.",
+	}, []string{"model", "type"})
+	cost = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alone_cost_usd_total",
+		Help: "Cost of completion calls in USD by model.",
+	}, []string{"model"})
+	deliveries = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alone_synology_deliveries_total",
+		Help: "Messages delivered to Synology Chat by result: ok or error.",
+	}, []string{"result"})
+	// QueueDepth is the count of received bot messages that are not answered yet
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "alone_queue_depth",
+		Help: "Received bot messages that are not answered yet.",
+	})
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "alone_http_requests_total",
+		Help: "HTTP requests by server, method, route and status code.",
+	}, []string{"server", "method", "route", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "alone_http_request_duration_seconds",
+		Help:    "Latency of HTTP requests by server, method and route.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"server", "method", "route"})
+)
+
+// Handler serves the metrics in the Prometheus text format
+func Handler() gin.HandlerFunc {
+	return gin.WrapH(promhttp.Handler())
+}
+
+// Middleware counts the requests of the gin router of server, e.g. "api" or "bot"
+func Middleware(server string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		// the route pattern keeps the label cardinality low, unmatched paths share one label
+		route := c.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(server, c.Request.Method, route, strconv.Itoa(c.Writer.Status())).Inc()
+		httpDuration.WithLabelValues(server, c.Request.Method, route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Sessions reports the count of active bot sessions returned by f
+func Sessions(f func() int) {
+	promauto.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "alone_active_sessions",
+		Help: "Synology Chat users with a bot session.",
+	}, func() float64 {
+		return float64(f())
+	})
+}
+
+// Delivery counts a message delivered to Synology Chat, err is the delivery error
+func Delivery(err error) {
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	deliveries.WithLabelValues(result).Inc()
+}
+
+// Backend counts the messages sent and streamed through the embedded GptBackend
+type Backend struct {
+	openai.GptBackend
+}
+
+// Instrument returns b counting its Send calls
+func Instrument(b openai.GptBackend) Backend {
+	return Backend{b}
+}
+
+func (b Backend) Send(ctx context.Context, conversationID uint, msg string) (openai.ChatCompletionMessage, error) {
+	resp, err := b.GptBackend.Send(ctx, conversationID, msg)
+	count(resp, err)
+	return resp, err
+}
+
+func (b Backend) SendStream(ctx context.Context, conversationID uint, msg string, delta func(string) error) (openai.ChatCompletionMessage, error) {
+	resp, err := b.GptBackend.SendStream(ctx, conversationID, msg, delta)
+	count(resp, err)
+	return resp, err
+}
+
+func (b Backend) Proxy(ctx context.Context, req gogpt.ChatCompletionRequest, delta func(string) error) (openai.ChatCompletionMessage, error) {
+	resp, err := b.GptBackend.Proxy(ctx, req, delta)
+	count(resp, err)
+	return resp, err
+}
+
+// count counts the answer resp of a Send call that returned err
+func count(resp openai.ChatCompletionMessage, err error) {
+	var policyErr *openai.PolicyError
+	switch {
+	case errors.As(err, &policyErr):
+		completions.WithLabelValues("", "rejected").Inc()
+	case resp.Cached:
+		completions.WithLabelValues(resp.ModelName, "cached").Inc()
+	case resp.Status == openai.MessageStatusError:
+		completions.WithLabelValues(resp.ModelName, "error").Inc()
+		completionDuration.WithLabelValues(resp.ModelName, "error").Observe(float64(resp.LatencyMs) / 1000)
+	case err != nil:
+		// failed before the completion call, e.g. an unknown conversation
+		completions.WithLabelValues("", "error").Inc()
+	default:
+		completions.WithLabelValues(resp.ModelName, "ok").Inc()
+		completionDuration.WithLabelValues(resp.ModelName, "ok").Observe(float64(resp.LatencyMs) / 1000)
+		tokens.WithLabelValues(resp.ModelName, "prompt").Add(float64(resp.PromptTokens))
+		tokens.WithLabelValues(resp.ModelName, "completion").Add(float64(resp.CompletionTokens))
+		cost.WithLabelValues(resp.ModelName).Add(openai.Cost(resp))
+	}
+}
@@ -0,0 +1,226 @@
+package openai
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// APIKey authenticates the requests of an owner. Only the sha256 of the key is stored, the
+// key itself is shown once when it is created.
+type APIKey struct {
+	ID        uint      `gorm:"primarykey" json:"id"`
+	CreatedAt time.Time `json:"created_at"`
+	Name      string    `json:"name"`
+	// Owner is the owner of the conversations of requests with this key, see Principal
+	Owner string `gorm:"index" json:"owner"`
+	// Prefix is the start of the key, it tells keys apart in listings
+	Prefix     string     `json:"prefix"`
+	Hash       string     `gorm:"uniqueIndex;size:64" json:"-"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+	// Scopes are the requests the key may make, see ScopeRead, ScopeChat and ScopeAdmin
+	Scopes []string `gorm:"serializer:json" json:"scopes"`
+	// RevokedAt is set when the key was revoked, revoked keys are kept for the listings
+	RevokedAt *time.Time `json:"revoked_at,omitempty"`
+}
+
+func (APIKey) TableName() string {
+	return "api_key"
+}
+
+// Scopes of API keys
+const (
+	// ScopeRead reads the conversations, messages, system roles and reports of the owner
+	ScopeRead = "read"
+	// ScopeChat creates conversations and sends messages
+	ScopeChat = "chat"
+	// ScopeAdmin allows everything and acts for all owners, see Principal.Admin
+	ScopeAdmin = "admin"
+)
+
+// Scopes are the valid API key scopes
+var Scopes = []string{ScopeRead, ScopeChat, ScopeAdmin}
+
+// HasScope reports whether k grants scope, admin keys grant all scopes
+func (k APIKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// Revoked reports whether k was revoked
+func (k APIKey) Revoked() bool {
+	return k.RevokedAt != nil
+}
+
+// Principal is the caller authenticated by k
+func (k APIKey) Principal() Principal {
+	return Principal{Owner: k.Owner, Admin: k.HasScope(ScopeAdmin)}
+}
+
+// apiKeyPrefix starts every key, so leaked keys are easy to find in code and logs
+const apiKeyPrefix = "alone-"
+
+var (
+	// ErrInvalidAPIKey is returned for unknown and revoked keys
+	ErrInvalidAPIKey = errors.New("invalid api key")
+	// ErrInvalidScope is returned for keys without scopes or with unknown scopes
+	ErrInvalidScope = errors.New("invalid api key scope")
+)
+
+// APIKeyFilter selects API keys, zero value fields are ignored
+type APIKeyFilter struct {
+	ListOptions
+	Owner string
+	// Revoked includes revoked keys
+	Revoked bool
+}
+
+// KeyStore stores API keys. Keys are restricted to the Principal of the context like conversations.
+type KeyStore interface {
+	// CreateAPIKey stores k with a new key and returns the key
+	CreateAPIKey(ctx context.Context, k *APIKey) (string, error)
+	// AuthenticateAPIKey returns the stored key of key, ErrInvalidAPIKey when there is none
+	AuthenticateAPIKey(ctx context.Context, key string) (APIKey, error)
+	ListAPIKeys(ctx context.Context, f APIKeyFilter) ([]APIKey, int64, error)
+	// GetAPIKey returns the key with id, revoked or not
+	GetAPIKey(ctx context.Context, id uint) (APIKey, error)
+	// RevokeAPIKey revokes the key with id, requests with it fail from then on
+	RevokeAPIKey(ctx context.Context, id uint) error
+}
+
+var _ KeyStore = (*GormStore)(nil)
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey generates a random key for k
+func (s *GormStore) CreateAPIKey(ctx context.Context, k *APIKey) (string, error) {
+	if k.Owner == "" {
+		return "", errors.New("api key has no owner")
+	}
+	if err := validateScopes(k.Scopes); err != nil {
+		return "", err
+	}
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	k.ID, k.Hash, k.Prefix, k.RevokedAt = 0, hashAPIKey(key), key[:len(apiKeyPrefix)+6], nil
+	if err := s.create(ctx, k); err != nil {
+		return "", err
+	}
+	return key, nil
+}
+
+// AuthenticateAPIKey looks up key by its hash and records its use
+func (s *GormStore) AuthenticateAPIKey(ctx context.Context, key string) (APIKey, error) {
+	var k APIKey
+	if !strings.HasPrefix(key, apiKeyPrefix) {
+		return k, ErrInvalidAPIKey
+	}
+	// Find, unlike First, does not log unknown keys as errors
+	res := s.db.WithContext(ctx).Where("hash = ? AND revoked_at IS NULL", hashAPIKey(key)).Limit(1).Find(&k)
+	if res.Error != nil {
+		logStoreError(ctx, "authenticate api key", res.Error)
+		return k, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return k, ErrInvalidAPIKey
+	}
+	now := time.Now()
+	if err := s.db.WithContext(ctx).Model(&k).UpdateColumn("last_used_at", now).Error; err != nil {
+		logStoreError(ctx, "record api key use", err)
+	}
+	k.LastUsedAt = &now
+	return k, nil
+}
+
+var apiKeySortable = map[string]bool{"id": true, "name": true, "owner": true, "created_at": true, "last_used_at": true}
+
+// ListAPIKeys lists the keys of the principal of ctx, all keys for admins
+func (s *GormStore) ListAPIKeys(ctx context.Context, f APIKeyFilter) ([]APIKey, int64, error) {
+	q := s.ownedAPIKeys(ctx, s.db.WithContext(ctx).Model(&APIKey{}))
+	if f.Owner != "" {
+		q = q.Where("owner = ?", f.Owner)
+	}
+	if !f.Revoked {
+		q = q.Where("revoked_at IS NULL")
+	}
+	var keys []APIKey
+	total, err := list(q, &keys, apiKeySortable, f.ListOptions)
+	return keys, total, err
+}
+
+// GetAPIKey returns a key of the principal of ctx
+func (s *GormStore) GetAPIKey(ctx context.Context, id uint) (APIKey, error) {
+	var k APIKey
+	res := s.ownedAPIKeys(ctx, s.db.WithContext(ctx)).Limit(1).Find(&k, id)
+	if res.Error != nil {
+		logStoreError(ctx, "get api key", res.Error)
+		return k, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return k, &NotFoundError{Resource: "api key", ID: fmt.Sprint(id)}
+	}
+	return k, nil
+}
+
+// RevokeAPIKey revokes a key of the principal of ctx, revoking a revoked key is a no-op
+func (s *GormStore) RevokeAPIKey(ctx context.Context, id uint) error {
+	k, err := s.GetAPIKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if k.Revoked() {
+		return nil
+	}
+	err = s.db.WithContext(ctx).Model(&k).UpdateColumn("revoked_at", time.Now()).Error
+	if err != nil {
+		logStoreError(ctx, "revoke api key", err)
+	}
+	return err
+}
+
+// ownedAPIKeys restricts q to the keys of the principal of ctx, q fails without principal
+func (s *GormStore) ownedAPIKeys(ctx context.Context, q *gorm.DB) *gorm.DB {
+	owner, ok, err := restricted(ctx)
+	if err != nil {
+		q.AddError(err)
+		return q
+	}
+	if ok {
+		return q.Where("owner = ?", owner)
+	}
+	return q
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("%w: no scopes", ErrInvalidScope)
+	}
+	for _, scope := range scopes {
+		valid := false
+		for _, s := range Scopes {
+			valid = valid || s == scope
+		}
+		if !valid {
+			return fmt.Errorf("%w: %q, valid scopes are %s", ErrInvalidScope, scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
@@ -2,14 +2,17 @@ package openai
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"net/http"
+	"strings"
 	"time"
 
+	"github.com/coolbit-in/alone/logging"
 	"github.com/google/uuid"
 	tokenizer "github.com/samber/go-gpt-3-encoder"
 	gogpt "github.com/sashabaranov/go-openai"
-	"gorm.io/gorm"
 )
 
 var (
@@ -18,44 +21,178 @@ var (
 
 func init() {
 	encoder, _ = tokenizer.NewEncoder()
-	//log = l.New(os.Stderr, "", l.LstdFlags|l.Lshortfile)
 }
 
-type SystemRoleDAO interface {
-	ListSystemRoles(query interface{}, args ...interface{}) ([]SystemRole, error)
-	GetSystemRole(id uint) (SystemRole, error)
-	AddSystemRole(*SystemRole) error
+// Completer sends a user message of a conversation to the model and returns the answer.
+// A zero conversationID starts a new conversation.
+type Completer interface {
+	Send(ctx context.Context, conversationID uint, msg string) (ChatCompletionMessage, error)
+	// SendStream is Send calling delta with every piece of the answer as it is generated. An
+	// error of delta aborts the answer. Token counts of streamed answers are estimated.
+	SendStream(ctx context.Context, conversationID uint, msg string, delta func(string) error) (ChatCompletionMessage, error)
+	// Proxy forwards the request of an OpenAI compatible client, see Gpt3p5.Proxy
+	Proxy(ctx context.Context, req gogpt.ChatCompletionRequest, delta func(string) error) (ChatCompletionMessage, error)
 }
 
 // GptBackend is the interface for GPT backend
 type GptBackend interface {
-	SystemRoleDAO
-	Send(conversationID uint, msg string) (ChatCompletionMessage, error)
-	GetConversation(id uint) (Conversation, error)
-	ListConversations(query interface{}, args ...interface{}) ([]Conversation, error)
-	GetMessage(id uint) (ChatCompletionMessage, error)
-	AddConversation(*Conversation) error
-	AddMessages([]ChatCompletionMessage) error
+	Store
+	Completer
 }
 
 var _ GptBackend = (*Gpt3p5)(nil)
 
-// Gpt3p5 implement the GptBackend
+// Gpt3p5 implement the GptBackend, conversations are persisted in the embedded Store
 type Gpt3p5 struct {
-	db     *gorm.DB
-	client *gogpt.Client
+	Store
+	client     *gogpt.Client
+	moderators map[string]Moderator
+	redactor   *Redactor
+	cache      ResponseCache
+	cacheTTL   time.Duration
+	// semantic cache, the threshold is the default of system roles without one
+	semantic    SemanticCache
+	embedder    Embedder
+	semanticTTL time.Duration
+	threshold   float32
+	stats       cacheStats
+	// proxyModeration moderates the messages of Proxy requests
+	proxyModeration ModerationPolicy
 }
 
-func NewGpt3p5(db *gorm.DB, key string) *Gpt3p5 {
-	return &Gpt3p5{
-		db:     db,
-		client: gogpt.NewClient(key),
+// Option configures a Gpt3p5
+type Option func(*Gpt3p5)
+
+// WithModerator registers m as moderation provider name, it replaces a built-in provider of the same name
+func WithModerator(name string, m Moderator) Option {
+	return func(b *Gpt3p5) {
+		b.moderators[name] = m
+	}
+}
+
+// WithRedactor redacts sensitive values of the prompts sent to the model with r
+func WithRedactor(r *Redactor) Option {
+	return func(b *Gpt3p5) {
+		b.redactor = r
+	}
+}
+
+func NewGpt3p5(store Store, key string, opts ...Option) *Gpt3p5 {
+	config := gogpt.DefaultConfig(key)
+	config.HTTPClient = &http.Client{Transport: requestIDTransport{http.DefaultTransport}}
+	b := &Gpt3p5{
+		Store:  store,
+		client: gogpt.NewClientWithConfig(config),
+	}
+	b.moderators = map[string]Moderator{
+		"openai":   openAIModerator{client: b.client},
+		"keywords": keywordModerator{},
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	return b
+}
+
+// ErrInvalidSystemRole is returned when a system role is rejected by validation
+var ErrInvalidSystemRole = errors.New("invalid system role")
+
+// AddSystemRole validates the template and the moderation policy of sr and adds it
+func (b *Gpt3p5) AddSystemRole(ctx context.Context, sr *SystemRole) error {
+	if err := b.validateSystemRole(sr); err != nil {
+		return err
 	}
+	return b.Store.AddSystemRole(ctx, sr)
+}
+
+// UpdateSystemRole validates the template and the moderation policy of sr and saves it as a new version
+func (b *Gpt3p5) UpdateSystemRole(ctx context.Context, sr *SystemRole) error {
+	if err := b.validateSystemRole(sr); err != nil {
+		return err
+	}
+	return b.Store.UpdateSystemRole(ctx, sr)
+}
+
+func (b *Gpt3p5) validateSystemRole(sr *SystemRole) error {
+	if err := validateSystemRole(sr.Content); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSystemRole, err)
+	}
+	if err := sr.Moderation.Validate(b.moderators); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSystemRole, err)
+	}
+	if err := sr.Sampling.Validate(); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSystemRole, err)
+	}
+	if sr.SimilarityThreshold < 0 || sr.SimilarityThreshold > 1 {
+		return fmt.Errorf("%w: similarity_threshold must be between 0 and 1", ErrInvalidSystemRole)
+	}
+	return nil
+}
+
+// AddConversation validates the sampling overrides of c and adds it
+func (b *Gpt3p5) AddConversation(ctx context.Context, c *Conversation) error {
+	if err := c.Sampling.Validate(); err != nil {
+		return err
+	}
+	return b.Store.AddConversation(ctx, c)
+}
+
+// SetConversationSampling validates s and replaces the sampling overrides of a conversation
+func (b *Gpt3p5) SetConversationSampling(ctx context.Context, id uint, s SamplingSettings) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	return b.Store.SetConversationSampling(ctx, id, s)
+}
+
+// systemRole returns the system role version pinned by c. Conversations created before
+// versioning pin no version and use the current version of their role.
+func (b *Gpt3p5) systemRole(ctx context.Context, c Conversation) (SystemRoleVersion, error) {
+	if c.SystemRoleVersion != 0 {
+		return b.GetSystemRoleVersion(ctx, c.SystemRoleID, c.SystemRoleVersion)
+	}
+	role, err := b.GetSystemRole(ctx, c.SystemRoleID)
+	if err != nil {
+		return SystemRoleVersion{}, err
+	}
+	return role.version(), nil
+}
+
+type requestIDKey struct{}
+
+// requestIDTransport records the x-request-id header of OpenAI responses in the *string
+// stored under requestIDKey in the request context
+type requestIDTransport struct {
+	base http.RoundTripper
+}
+
+func (t requestIDTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if id, ok := req.Context().Value(requestIDKey{}).(*string); ok && err == nil {
+		*id = resp.Header.Get("X-Request-Id")
+	}
+	return resp, err
+}
+
+func requestIDFrom(ctx context.Context) string {
+	if id, ok := ctx.Value(requestIDKey{}).(*string); ok {
+		return *id
+	}
+	return ""
 }
 
 // Bot implements GptBackend interface
 
-func (b *Gpt3p5) Send(conversationID uint, msg string) (resp ChatCompletionMessage, err error) {
+func (b *Gpt3p5) Send(ctx context.Context, conversationID uint, msg string) (ChatCompletionMessage, error) {
+	return b.send(ctx, conversationID, msg, nil)
+}
+
+func (b *Gpt3p5) SendStream(ctx context.Context, conversationID uint, msg string, delta func(string) error) (ChatCompletionMessage, error) {
+	return b.send(ctx, conversationID, msg, delta)
+}
+
+// send sends msg and streams the answer to delta unless it is nil
+func (b *Gpt3p5) send(ctx context.Context, conversationID uint, msg string, delta func(string) error) (resp ChatCompletionMessage, err error) {
 	if b.client == nil {
 		panic(fmt.Errorf("client is nil"))
 	}
@@ -67,13 +204,13 @@ func (b *Gpt3p5) Send(conversationID uint, msg string) (resp ChatCompletionMessa
 		c = Conversation{
 			Name: uuid.NewString(),
 		}
-		if err = b.AddConversation(&c); err != nil {
+		if err = b.AddConversation(ctx, &c); err != nil {
 			return resp, err
 		}
 		conversationID = c.ID
 	} else {
 		// get conversation and messages
-		c, err = b.GetConversation(conversationID)
+		c, err = b.GetConversation(ctx, conversationID)
 		if err != nil {
 			return resp, err
 		}
@@ -87,36 +224,450 @@ func (b *Gpt3p5) Send(conversationID uint, msg string) (resp ChatCompletionMessa
 		Role:           "user",
 		Content:        msg,
 	}
-	msgs := b.buildMessages(newMsg, c.Messages)
+	var role SystemRoleVersion
+	var system string
+	if c.SystemRoleID != 0 {
+		if role, err = b.systemRole(ctx, c); err != nil {
+			return resp, err
+		}
+		vars, _ := TemplateVarsFrom(ctx)
+		if system, err = RenderSystemRole(role.Content, vars); err != nil {
+			return resp, fmt.Errorf("system role %d version %d: %w", role.SystemRoleID, role.Version, err)
+		}
+	}
+	var rd *redaction
+	if b.redactor != nil {
+		rd = b.redactor.begin()
+	}
+	if err = b.moderate(ctx, role.Moderation, rd, &newMsg); err != nil {
+		return resp, err
+	}
+	sampling := role.Sampling.Merge(c.Sampling)
+	msgs, err := b.buildMessages(ctx, sampling.promptLimit(), system, newMsg, c.Messages)
+	if err != nil {
+		return resp, err
+	}
+	// prompt is the user message as it is sent to the model
+	prompt := newMsg.Content
+	if rd != nil {
+		for i := range msgs {
+			msgs[i].Content = rd.redact(msgs[i].Content)
+		}
+		prompt = rd.redact(prompt)
+		if len(rd.counts) > 0 {
+			logging.Info(ctx, "prompt redacted", "conversation_id", conversationID, "redacted", rd.String())
+		}
+	}
 	req := gogpt.ChatCompletionRequest{
 		Model:    gogpt.GPT3Dot5Turbo0301,
 		Messages: msgs,
 	}
+	sampling.apply(&req)
+	var lookup cacheLookup
+	if contextFree(c.Messages) {
+		var cached *CachedResponse
+		// the caches only see the redacted prompt and answer, the embedding is sent to OpenAI too
+		lookup, cached = b.lookupCache(ctx, role, responseCacheScope(req.Model, role, system, sampling), prompt)
+		if cached != nil {
+			if resp, ok := b.answerFromCache(ctx, *cached, rd, newMsg); ok {
+				if delta != nil {
+					if err := delta(resp.Content); err != nil {
+						return resp, err
+					}
+				}
+				return resp, nil
+			}
+		}
+	}
 	// send to GPT
-	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	callCtx, cancel := context.WithTimeout(context.WithValue(ctx, requestIDKey{}, new(string)), 60*time.Second)
 	defer cancel()
-	chatResp, err := b.client.CreateChatCompletion(ctx, req)
+	start := time.Now()
+	var answer completion
+	if delta == nil {
+		answer, err = b.complete(callCtx, req)
+	} else {
+		answer, err = b.completeStream(callCtx, req, rd, delta)
+	}
+	resp = ChatCompletionMessage{
+		ConversationID: conversationID,
+		Role:           gogpt.ChatMessageRoleAssistant,
+		ModelName:      req.Model,
+		LatencyMs:      time.Since(start).Milliseconds(),
+		RequestID:      requestIDFrom(callCtx),
+		Status:         MessageStatusOK,
+	}
 	if err != nil {
+		// a partly streamed answer is kept with the error
+		resp.Content = answer.Content
+		if rd != nil {
+			resp.Content = rd.restore(resp.Content)
+		}
+		// keep the failed attempt, it is excluded from the context of later requests
+		newMsg.Status, resp.Status, resp.Error = MessageStatusError, MessageStatusError, err.Error()
+		logging.Error(ctx, "chat completion failed", "conversation_id", conversationID,
+			"model", req.Model, "latency_ms", resp.LatencyMs, "request_id", resp.RequestID, "error", err)
+		if serr := b.AddMessages(ctx, []ChatCompletionMessage{newMsg, resp}); serr != nil {
+			logging.Error(ctx, "save failed completion", "conversation_id", conversationID, "error", serr)
+		}
 		return resp, err
 	}
-	// log print usage
-	log.Print("Prompt Tokens: ", chatResp.Usage.PromptTokens)
-	log.Print("Complation Tokens: ", chatResp.Usage.CompletionTokens)
-	log.Print("Total Tokens: ", chatResp.Usage.TotalTokens)
+	logging.Info(ctx, "chat completion", "conversation_id", conversationID, "model", answer.Model,
+		"latency_ms", resp.LatencyMs, "request_id", resp.RequestID, "prompt_tokens", answer.PromptTokens,
+		"completion_tokens", answer.CompletionTokens, "finish_reason", answer.FinishReason,
+		"stream", delta != nil)
+	logging.Debug(ctx, "chat completion content", "conversation_id", conversationID,
+		"prompt", logging.Content(prompt), "answer", logging.Content(answer.Content))
 
 	// save the newMsg and response to db
-	resp = ChatCompletionMessage{
-		ConversationID:   conversationID,
+	newMsg.Status = MessageStatusOK
+	if answer.Role != "" {
+		resp.Role = answer.Role
+	}
+	resp.Content = answer.Content
+	if rd != nil {
+		resp.Content = rd.restore(resp.Content)
+	}
+	resp.FinishReason = answer.FinishReason
+	resp.PromptTokens = answer.PromptTokens
+	resp.CompletionTokens = answer.CompletionTokens
+	if answer.Model != "" {
+		resp.ModelName = answer.Model
+	}
+	if resp.RequestID == "" {
+		resp.RequestID = answer.ID
+	}
+	save := []ChatCompletionMessage{newMsg, resp}
+	if err = b.AddMessages(ctx, save); err != nil {
+		return resp, err
+	}
+	// truncated answers are not worth repeating
+	if resp.FinishReason == "stop" {
+		b.storeCache(ctx, lookup, resp, answer.Content)
+	}
+	return save[1], nil
+}
+
+// completion is the answer of a chat completion call
+type completion struct {
+	ID, Model, Role, Content, FinishReason string
+	PromptTokens, CompletionTokens         int
+}
+
+// RateLimitError is returned when OpenAI rejects a call with 429 for its rate or quota limits
+type RateLimitError struct {
+	Err error
+}
+
+func (e *RateLimitError) Error() string {
+	return "rate limited by OpenAI: " + e.Err.Error()
+}
+
+func (e *RateLimitError) Unwrap() error {
+	return e.Err
+}
+
+// rateLimited turns the 429 errors of OpenAI calls into RateLimitErrors
+func rateLimited(err error) error {
+	var apiErr *gogpt.APIError
+	var reqErr *gogpt.RequestError
+	if (errors.As(err, &apiErr) && apiErr.StatusCode == http.StatusTooManyRequests) ||
+		(errors.As(err, &reqErr) && reqErr.StatusCode == http.StatusTooManyRequests) {
+		return &RateLimitError{Err: err}
+	}
+	return err
+}
+
+// complete calls the chat completion endpoint
+func (b *Gpt3p5) complete(ctx context.Context, req gogpt.ChatCompletionRequest) (completion, error) {
+	chatResp, err := b.client.CreateChatCompletion(ctx, req)
+	if err != nil {
+		return completion{}, rateLimited(err)
+	}
+	if len(chatResp.Choices) == 0 {
+		return completion{}, fmt.Errorf("chat completion %s has no choices", chatResp.ID)
+	}
+	return completion{
+		ID:               chatResp.ID,
+		Model:            chatResp.Model,
 		Role:             chatResp.Choices[0].Message.Role,
 		Content:          chatResp.Choices[0].Message.Content,
+		FinishReason:     chatResp.Choices[0].FinishReason,
 		PromptTokens:     chatResp.Usage.PromptTokens,
 		CompletionTokens: chatResp.Usage.CompletionTokens,
+	}, nil
+}
+
+// completeStream calls the chat completion endpoint in stream mode and passes the pieces of the
+// answer to delta with the placeholders of rd restored. Streams report no usage, the token
+// counts are estimated with the tokenizer. The returned content is the redacted answer received
+// so far, also on errors.
+func (b *Gpt3p5) completeStream(ctx context.Context, req gogpt.ChatCompletionRequest, rd *redaction, delta func(string) error) (completion, error) {
+	req.Stream = true
+	stream, err := b.client.CreateChatCompletionStream(ctx, req)
+	if err != nil {
+		return completion{}, rateLimited(err)
+	}
+	defer stream.Close()
+	res := completion{Role: gogpt.ChatMessageRoleAssistant}
+	var content strings.Builder
+	out := &streamRestorer{rd: rd, delta: delta}
+	for {
+		chunk, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			res.Content = content.String()
+			return res, err
+		}
+		res.ID, res.Model = chunk.ID, chunk.Model
+		if len(chunk.Choices) == 0 {
+			continue
+		}
+		if reason := chunk.Choices[0].FinishReason; reason != "" {
+			res.FinishReason = reason
+		}
+		content.WriteString(chunk.Choices[0].Delta.Content)
+		if err := out.write(chunk.Choices[0].Delta.Content); err != nil {
+			res.Content = content.String()
+			return res, err
+		}
+	}
+	res.Content = content.String()
+	if err := out.flush(); err != nil {
+		return res, err
+	}
+	res.PromptTokens = promptTokens(req.Messages)
+	l, _ := encoder.Encode(res.Content)
+	res.CompletionTokens = len(l)
+	return res, nil
+}
+
+// streamRestorer restores redaction placeholders in streamed pieces. A placeholder may be
+// split over pieces, so text from an unclosed "[" on is held back until it is closed.
+type streamRestorer struct {
+	rd      *redaction
+	delta   func(string) error
+	pending string
+}
+
+// maxPlaceholder bounds the held back text, longer brackets are no placeholders
+const maxPlaceholder = 32
+
+func (s *streamRestorer) write(piece string) error {
+	if s.rd == nil || len(s.rd.values) == 0 {
+		if piece == "" {
+			return nil
+		}
+		return s.delta(piece)
+	}
+	s.pending += piece
+	cut := len(s.pending)
+	if i := strings.LastIndexByte(s.pending, '['); i >= 0 && !strings.Contains(s.pending[i:], "]") &&
+		len(s.pending)-i < maxPlaceholder {
+		cut = i
+	}
+	out := s.rd.restore(s.pending[:cut])
+	s.pending = s.pending[cut:]
+	if out == "" {
+		return nil
+	}
+	return s.delta(out)
+}
+
+func (s *streamRestorer) flush() error {
+	if s.pending == "" {
+		return nil
+	}
+	out := s.rd.restore(s.pending)
+	s.pending = ""
+	return s.delta(out)
+}
+
+// promptTokens estimates the prompt tokens of msgs like the chat completion endpoint counts them
+func promptTokens(msgs []gogpt.ChatCompletionMessage) int {
+	res := 3
+	for _, msg := range msgs {
+		l, _ := encoder.Encode(msg.Role)
+		res += 3 + len(l)
+		l, _ = encoder.Encode(msg.Content)
+		res += len(l)
+	}
+	return res
+}
+
+// cacheLookup holds what is needed to cache the answer after a cache miss
+type cacheLookup struct {
+	digest    string
+	scope     string
+	embedding []float32
+}
+
+// lookupCache looks up a context-free prompt in the exact and then in the semantic cache. The prompt
+// is redacted, so prompts differing only in redacted values share their answers. Cache errors are
+// logged and count as misses.
+func (b *Gpt3p5) lookupCache(ctx context.Context, role SystemRoleVersion, scope, prompt string) (cacheLookup, *CachedResponse) {
+	var lookup cacheLookup
+	if b.cache != nil {
+		lookup.digest = responseCacheKey(scope, prompt)
+		cached, ok, err := b.cache.GetCachedResponse(ctx, lookup.digest)
+		b.stats.count("exact", role.SystemRoleID, ok, -1)
+		if err == nil && ok {
+			logging.Info(ctx, "answered from response cache", "system_role_id", role.SystemRoleID)
+			return lookup, &cached
+		}
+	}
+	threshold := role.SimilarityThreshold
+	if threshold == 0 {
+		threshold = b.threshold
+	}
+	if b.semantic == nil || threshold == 0 {
+		return lookup, nil
+	}
+	embedding, err := b.embedder.Embed(ctx, prompt)
+	if err != nil {
+		logging.Warn(ctx, "embed prompt", "error", err)
+		return lookup, nil
+	}
+	lookup.scope, lookup.embedding = scope, embedding
+	entry, similarity, ok, err := b.semantic.FindSimilarResponse(ctx, scope, embedding)
+	if err != nil || !ok {
+		b.stats.count("semantic", role.SystemRoleID, false, -1)
+		return lookup, nil
+	}
+	hit := similarity >= threshold
+	b.stats.count("semantic", role.SystemRoleID, hit, similarity)
+	logging.Info(ctx, "semantic cache lookup", "system_role_id", role.SystemRoleID,
+		"similarity", similarity, "threshold", threshold, "hit", hit)
+	if !hit {
+		return lookup, nil
+	}
+	if err := b.semantic.CountSimilarHit(ctx, entry.ID); err != nil {
+		logging.Error(ctx, "count semantic cache hit", "error", err)
+	}
+	// the answer is already cached for this prompt
+	lookup.embedding = nil
+	return lookup, &CachedResponse{Model: entry.Model, Content: entry.Content, FinishReason: entry.FinishReason}
+}
+
+// storeCache caches the answer resp of a prompt that missed the caches. The cached content is the
+// answer as the model sent it, its placeholders are restored with the values of the requests it answers.
+func (b *Gpt3p5) storeCache(ctx context.Context, lookup cacheLookup, resp ChatCompletionMessage, redacted string) {
+	if lookup.digest != "" {
+		err := b.cache.PutCachedResponse(ctx, CachedResponse{
+			Digest:           lookup.digest,
+			Model:            resp.ModelName,
+			Content:          redacted,
+			FinishReason:     resp.FinishReason,
+			PromptTokens:     resp.PromptTokens,
+			CompletionTokens: resp.CompletionTokens,
+			ExpiresAt:        time.Now().Add(b.cacheTTL),
+		})
+		if err != nil {
+			logging.Error(ctx, "store response cache", "error", err)
+		}
+	}
+	if lookup.embedding != nil {
+		err := b.semantic.PutSimilarResponse(ctx, SemanticCacheEntry{
+			Scope:        lookup.scope,
+			Embedding:    encodeEmbedding(lookup.embedding),
+			Model:        resp.ModelName,
+			Content:      redacted,
+			FinishReason: resp.FinishReason,
+			ExpiresAt:    time.Now().Add(b.semanticTTL),
+		})
+		if err != nil {
+			logging.Error(ctx, "store semantic cache", "error", err)
+		}
+	}
+}
+
+// CacheStats reports the lookups of the response caches since the start of the process
+func (b *Gpt3p5) CacheStats() []CacheStats {
+	return b.stats.report()
+}
+
+// Ping checks that the OpenAI API is reachable and accepts the API key by listing the models
+func (b *Gpt3p5) Ping(ctx context.Context) error {
+	_, err := b.client.ListModels(ctx)
+	return err
+}
+
+// answerFromCache stores newMsg with the cached answer, whose placeholders are restored with rd
+// unless it is nil. Errors are logged and count as misses.
+func (b *Gpt3p5) answerFromCache(ctx context.Context, cached CachedResponse, rd *redaction, newMsg ChatCompletionMessage) (ChatCompletionMessage, bool) {
+	newMsg.Status = MessageStatusOK
+	content := cached.Content
+	if rd != nil {
+		content = rd.restore(content)
+	}
+	resp := ChatCompletionMessage{
+		ConversationID: newMsg.ConversationID,
+		Role:           gogpt.ChatMessageRoleAssistant,
+		Content:        content,
+		ModelName:      cached.Model,
+		FinishReason:   cached.FinishReason,
+		Status:         MessageStatusOK,
+		Cached:         true,
 	}
 	save := []ChatCompletionMessage{newMsg, resp}
-	if err = b.AddMessages(save); err != nil {
-		return resp, err
+	if err := b.AddMessages(ctx, save); err != nil {
+		logging.Error(ctx, "save cached answer", "conversation_id", newMsg.ConversationID, "error", err)
+		return ChatCompletionMessage{}, false
+	}
+	return save[1], true
+}
+
+// moderate applies policy to the user message msg. Rejected messages are stored and
+// a *PolicyError is returned, flagged messages are marked and may be rewritten. The provider
+// checks msg redacted with rd unless it is nil, so sensitive values never reach it.
+func (b *Gpt3p5) moderate(ctx context.Context, policy ModerationPolicy, rd *redaction, msg *ChatCompletionMessage) error {
+	if policy.Provider == "" {
+		return nil
+	}
+	m, ok := b.moderators[policy.Provider]
+	if !ok {
+		return fmt.Errorf("unknown moderation provider %q", policy.Provider)
+	}
+	text := msg.Content
+	if rd != nil {
+		text = rd.redact(text)
+	}
+	res, err := m.Moderate(ctx, policy, text)
+	if err != nil {
+		return fmt.Errorf("moderation: %w", err)
+	}
+	if !res.Flagged {
+		return nil
 	}
-	return resp, nil
+	msg.Flagged = true
+	msg.ModerationReasons = strings.Join(res.Reasons, ", ")
+	logging.Warn(ctx, "message flagged", "conversation_id", msg.ConversationID, "provider", policy.Provider,
+		"reasons", msg.ModerationReasons, "action", policy.action())
+	switch action := policy.action(); {
+	case action == ModerationFlag:
+		return nil
+	case action == ModerationRewrite && res.Rewritten != "":
+		msg.Content = res.Rewritten
+		if rd != nil {
+			msg.Content = rd.restore(msg.Content)
+		}
+		return nil
+	}
+	msg.Status = MessageStatusRejected
+	if err := b.AddMessages(ctx, []ChatCompletionMessage{*msg}); err != nil {
+		logging.Error(ctx, "save rejected message", "conversation_id", msg.ConversationID, "error", err)
+	}
+	return &PolicyError{Reasons: res.Reasons, Notice: policy.notice()}
+}
+
+// pricePerThousandTokens is the price in USD of 1000 gpt-3.5-turbo tokens
+const pricePerThousandTokens = 0.002
+
+// Cost returns the price in USD of the tokens used by the completion call of msg
+func Cost(msg ChatCompletionMessage) float64 {
+	return float64(msg.PromptTokens+msg.CompletionTokens) * pricePerThousandTokens / 1000
 }
 
 func TokenCalucate(msgs []ChatCompletionMessage) int {
@@ -135,17 +686,33 @@ func TokenCalucate(msgs []ChatCompletionMessage) int {
 	return res
 }
 
-func (b *Gpt3p5) buildMessages(new ChatCompletionMessage, history []ChatCompletionMessage) []gogpt.ChatCompletionMessage {
-	limit := 4000
+// ErrPromptTooLong is returned when a user message does not fit in the prompt limit with the system role
+var ErrPromptTooLong = errors.New("prompt too long")
+
+// buildMessages returns the system message, when system is not empty, followed by the latest
+// messages of history and new that fit in limit tokens. It fails with ErrPromptTooLong when new
+// does not fit.
+func (b *Gpt3p5) buildMessages(ctx context.Context, limit int, system string, new ChatCompletionMessage, history []ChatCompletionMessage) ([]gogpt.ChatCompletionMessage, error) {
+	total := limit
 	history = append(history, new)
 	msgs := []gogpt.ChatCompletionMessage{}
+	if system != "" {
+		l, _ := encoder.Encode(system)
+		limit -= 3 + len(l)
+	}
 	for i := len(history) - 1; i >= 0; i-- {
 		res, msg := 3, history[i]
+		if msg.Status == MessageStatusError || msg.Status == MessageStatusRejected {
+			continue
+		}
 		l, _ := encoder.Encode(msg.Role)
 		res += len(l)
 		l, _ = encoder.Encode(msg.Content)
 		res += len(l)
 		if res > limit {
+			if i == len(history)-1 {
+				return nil, fmt.Errorf("%w: the message has %d tokens, %d are left for it", ErrPromptTooLong, res, limit)
+			}
 			break
 		}
 		limit -= res
@@ -154,118 +721,14 @@ func (b *Gpt3p5) buildMessages(new ChatCompletionMessage, history []ChatCompleti
 			Content: msg.Content,
 		})
 	}
-	log.Printf("token length: %d", 4000-limit)
+	logging.Debug(ctx, "prompt built", "conversation_id", new.ConversationID, "messages", len(msgs), "tokens", total-limit)
 	// Reverse msgs
 	for i := len(msgs)/2 - 1; i >= 0; i-- {
 		opp := len(msgs) - 1 - i
 		msgs[i], msgs[opp] = msgs[opp], msgs[i]
 	}
-	return msgs
-}
-
-// GetConversation returns conversation by id and it's all messages
-func (b *Gpt3p5) GetConversation(id uint) (Conversation, error) {
-	var c Conversation
-	err := b.db.Model(&Conversation{}).Preload("Messages").
-		Where("id = ?", id).First(&c).Error
-	if err != nil {
-		log.Print(err)
-		return c, err
-	}
-	return c, nil
-}
-
-// ListConversations returns conversation filtered by where condition
-func (b *Gpt3p5) ListConversations(query interface{}, args ...interface{}) ([]Conversation, error) {
-	var cs []Conversation
-	q := b.db
-	if query != nil {
-		q = q.Where(query, args...)
+	if system != "" {
+		msgs = append([]gogpt.ChatCompletionMessage{{Role: gogpt.ChatMessageRoleSystem, Content: system}}, msgs...)
 	}
-	if err := q.Find(&cs).Error; err != nil {
-		log.Print(err)
-		return nil, err
-	}
-	return cs, nil
-}
-
-// GetMessage returns message by id
-func (b *Gpt3p5) GetMessage(id uint) (ChatCompletionMessage, error) {
-	var m ChatCompletionMessage
-	if err := b.db.Where("id = ?", id).First(&m).Error; err != nil {
-		log.Print(err)
-		return m, err
-	}
-	return m, nil
-}
-
-// AddConversation add a new conversation to db
-func (b *Gpt3p5) AddConversation(c *Conversation) error {
-	tx := b.db.Begin()
-	if err := tx.Create(c).Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	if err := tx.Commit().Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	return nil
-}
-
-func (b *Gpt3p5) AddMessages(msgs []ChatCompletionMessage) error {
-	tx := b.db.Begin()
-	if err := tx.Create(&msgs).Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	if err := tx.Commit().Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	return nil
-}
-
-// ListSystemRoles returns system roles filtered by where condition
-func (b *Gpt3p5) ListSystemRoles(query interface{}, args ...interface{}) ([]SystemRole, error) {
-	var sr []SystemRole
-	q := b.db
-	if query != nil {
-		q = q.Where(query, args...)
-	}
-	if err := q.Find(&sr).Error; err != nil {
-		log.Print(err)
-		return nil, err
-	}
-	return sr, nil
-}
-
-// GetSystemRole returns system role by id
-func (b *Gpt3p5) GetSystemRole(id uint) (SystemRole, error) {
-	var sr SystemRole
-	if err := b.db.Where("id = ?", id).First(&sr).Error; err != nil {
-		log.Print(err)
-		return sr, err
-	}
-	return sr, nil
-}
-
-// AddSystemRole adds a system role
-func (b *Gpt3p5) AddSystemRole(sr *SystemRole) error {
-	tx := b.db.Begin()
-	if err := tx.Create(&sr).Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	if err := tx.Commit().Error; err != nil {
-		tx.Rollback()
-		log.Print(err)
-		return err
-	}
-	return nil
+	return msgs, nil
 }
@@ -0,0 +1,133 @@
+package openai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// CachedResponse is an answer of the response cache
+type CachedResponse struct {
+	// Digest is the hex encoded sha256 of the cache key, see responseCacheKey
+	Digest string `gorm:"primaryKey;size:64"`
+	Model  string
+	// Content is the answer as the model sent it, with the redaction placeholders of the prompt
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	CreatedAt        time.Time
+	ExpiresAt        time.Time `gorm:"index"`
+	Hits             int
+}
+
+func (CachedResponse) TableName() string {
+	return "response_cache"
+}
+
+// ResponseCache stores answers of context-free prompts
+type ResponseCache interface {
+	// GetCachedResponse returns the unexpired answer of digest, ok is false on a miss
+	GetCachedResponse(ctx context.Context, digest string) (r CachedResponse, ok bool, err error)
+	PutCachedResponse(ctx context.Context, r CachedResponse) error
+	// PurgeResponseCache deletes expired answers of the exact and the semantic cache, or all
+	// answers when expiredOnly is false, and returns the count of deleted answers
+	PurgeResponseCache(ctx context.Context, expiredOnly bool) (int64, error)
+}
+
+var _ ResponseCache = (*GormStore)(nil)
+
+// WithResponseCache answers context-free prompts from cache, answers are kept for ttl
+func WithResponseCache(cache ResponseCache, ttl time.Duration) Option {
+	return func(b *Gpt3p5) {
+		b.cache, b.cacheTTL = cache, ttl
+	}
+}
+
+// responseCacheScope hashes everything but the prompt that shapes the answer of a context-free prompt
+func responseCacheScope(model string, role SystemRoleVersion, system string, sampling SamplingSettings) string {
+	scope, _ := json.Marshal(struct {
+		Model        string
+		SystemRoleID uint
+		Version      int
+		System       string
+		Sampling     SamplingSettings
+	}{model, role.SystemRoleID, role.Version, system, sampling})
+	sum := sha256.Sum256(scope)
+	return hex.EncodeToString(sum[:])
+}
+
+// responseCacheKey hashes the scope and the redacted prompt. The prompt is normalized by collapsing
+// whitespace, so re-indented pastes still hit.
+func responseCacheKey(scope string, prompt string) string {
+	sum := sha256.Sum256([]byte(scope + "\n" + strings.Join(strings.Fields(prompt), " ")))
+	return hex.EncodeToString(sum[:])
+}
+
+// contextFree reports whether history has no message that would be sent with a new prompt
+func contextFree(history []ChatCompletionMessage) bool {
+	for _, m := range history {
+		if m.Status != MessageStatusError && m.Status != MessageStatusRejected {
+			return false
+		}
+	}
+	return true
+}
+
+// GetCachedResponse returns the unexpired answer of digest and counts the hit
+func (s *GormStore) GetCachedResponse(ctx context.Context, digest string) (CachedResponse, bool, error) {
+	var r CachedResponse
+	res := s.db.WithContext(ctx).Where("digest = ? AND expires_at > ?", digest, time.Now()).Limit(1).Find(&r)
+	if res.Error != nil {
+		logging.Error(ctx, "get cached response", "error", res.Error)
+		return r, false, res.Error
+	}
+	if res.RowsAffected == 0 {
+		return r, false, nil
+	}
+	err := s.db.WithContext(ctx).Model(&CachedResponse{}).Where("digest = ?", digest).
+		UpdateColumn("hits", gorm.Expr("hits + 1")).Error
+	if err != nil {
+		logging.Error(ctx, "count cached response hit", "error", err)
+	}
+	return r, true, s.open(&r.Content)
+}
+
+// PutCachedResponse stores r, replacing an earlier answer of the same digest
+func (s *GormStore) PutCachedResponse(ctx context.Context, r CachedResponse) error {
+	if err := s.seal(&r.Content); err != nil {
+		return err
+	}
+	err := s.db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&r).Error
+	if err != nil {
+		logging.Error(ctx, "put cached response", "error", err)
+	}
+	return err
+}
+
+// PurgeResponseCache deletes expired answers, or all answers when expiredOnly is false
+func (s *GormStore) PurgeResponseCache(ctx context.Context, expiredOnly bool) (int64, error) {
+	var deleted int64
+	for _, model := range []interface{}{&CachedResponse{}, &SemanticCacheEntry{}} {
+		q := s.db.WithContext(ctx)
+		if expiredOnly {
+			q = q.Where("expires_at <= ?", time.Now())
+		} else {
+			q = q.Where("1 = 1")
+		}
+		res := q.Delete(model)
+		if res.Error != nil {
+			logging.Error(ctx, "purge response cache", "error", res.Error)
+			return deleted, res.Error
+		}
+		deleted += res.RowsAffected
+	}
+	return deleted, nil
+}
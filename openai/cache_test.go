@@ -0,0 +1,273 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+// fakeOpenAI answers chat completions with answer and records the prompts it gets
+type fakeOpenAI struct {
+	answer string
+
+	mu      sync.Mutex
+	prompts []string
+}
+
+func (f *fakeOpenAI) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var req gogpt.ChatCompletionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.mu.Lock()
+	f.prompts = append(f.prompts, req.Messages[len(req.Messages)-1].Content)
+	f.mu.Unlock()
+	json.NewEncoder(w).Encode(gogpt.ChatCompletionResponse{
+		ID:    "chatcmpl-test",
+		Model: req.Model,
+		Choices: []gogpt.ChatCompletionChoice{{
+			Message:      gogpt.ChatCompletionMessage{Role: gogpt.ChatMessageRoleAssistant, Content: f.answer},
+			FinishReason: "stop",
+		}},
+	})
+}
+
+func (f *fakeOpenAI) calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.prompts...)
+}
+
+// newTestBackend returns a backend on store calling a fake OpenAI API that answers answer
+func newTestBackend(t *testing.T, store *GormStore, answer string, opts ...Option) (*Gpt3p5, *fakeOpenAI) {
+	fake := &fakeOpenAI{answer: answer}
+	srv := httptest.NewServer(fake)
+	t.Cleanup(srv.Close)
+	b := NewGpt3p5(store, "sk-test", opts...)
+	config := gogpt.DefaultConfig("sk-test")
+	config.BaseURL = srv.URL + "/v1"
+	b.client = gogpt.NewClientWithConfig(config)
+	return b, fake
+}
+
+func owner(name string) context.Context {
+	return WithPrincipal(context.Background(), Principal{Owner: name})
+}
+
+func TestResponseCache(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	now := time.Now()
+	for _, r := range []CachedResponse{
+		{Digest: "fresh", Content: "fresh answer", ExpiresAt: now.Add(time.Hour)},
+		{Digest: "expired", Content: "expired answer", ExpiresAt: now.Add(-time.Second)},
+	} {
+		if err := s.PutCachedResponse(ctx, r); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		digest string
+		hit    bool
+	}{
+		{"fresh", true},
+		{"expired", false},
+		{"unknown", false},
+	} {
+		r, ok, err := s.GetCachedResponse(ctx, tc.digest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ok != tc.hit || (ok && r.Content != "fresh answer") {
+			t.Errorf("get %s returned %q, %v, want hit %v", tc.digest, r.Content, ok, tc.hit)
+		}
+	}
+
+	err := s.PutSimilarResponse(ctx, SemanticCacheEntry{Scope: "s", Content: "expired", ExpiresAt: now.Add(-time.Second)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		expiredOnly bool
+		deleted     int64
+	}{
+		// the expired answers of both caches
+		{true, 2},
+		{true, 0},
+		{false, 1},
+	} {
+		n, err := s.PurgeResponseCache(ctx, tc.expiredOnly)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != tc.deleted {
+			t.Errorf("purge expired only %v deleted %d, want %d", tc.expiredOnly, n, tc.deleted)
+		}
+	}
+}
+
+func TestSemanticCache(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	embedder := HashEmbedder{}
+	embed := func(text string) []float32 {
+		v, _ := embedder.Embed(ctx, text)
+		return v
+	}
+	now := time.Now()
+	for _, e := range []SemanticCacheEntry{
+		{Scope: "role", Embedding: encodeEmbedding(embed("write a note to [EMAIL_1]")), Content: "note", ExpiresAt: now.Add(time.Hour)},
+		{Scope: "role", Embedding: encodeEmbedding(embed("how is the weather today")), Content: "weather", ExpiresAt: now.Add(-time.Second)},
+		{Scope: "other role", Embedding: encodeEmbedding(embed("how is the weather today")), Content: "other", ExpiresAt: now.Add(time.Hour)},
+	} {
+		if err := s.PutSimilarResponse(ctx, e); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, tc := range []struct {
+		name, scope, prompt string
+		// content is the best unexpired answer of scope, empty when there is none
+		content string
+		minSim  float32
+	}{
+		{"same prompt", "role", "write a note to [EMAIL_1]", "note", 0.999},
+		{"similar prompt", "role", "please write a note to [EMAIL_1]", "note", 0.9},
+		{"expired answers are skipped", "role", "how is the weather today", "note", 0},
+		{"other scope", "other role", "write a note to [EMAIL_1]", "other", 0},
+		{"empty scope", "no role", "write a note to [EMAIL_1]", "", 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			e, sim, ok, err := s.FindSimilarResponse(ctx, tc.scope, embed(tc.prompt))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if ok != (tc.content != "") || e.Content != tc.content {
+				t.Fatalf("found %q, %v, want %q", e.Content, ok, tc.content)
+			}
+			if sim < tc.minSim {
+				t.Errorf("similarity is %f, want at least %f", sim, tc.minSim)
+			}
+		})
+	}
+}
+
+func TestLookupCacheThreshold(t *testing.T) {
+	s := newTestStore(t)
+	ctx := context.Background()
+	embedding, _ := HashEmbedder{}.Embed(ctx, "write a note to [EMAIL_1]")
+	err := s.PutSimilarResponse(ctx, SemanticCacheEntry{Scope: "scope", Embedding: encodeEmbedding(embedding),
+		Content: "note", ExpiresAt: time.Now().Add(time.Hour)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the similarity of the prompt and the cached prompt is about 0.92
+	const prompt = "please write a note to [EMAIL_1]"
+	for _, tc := range []struct {
+		name                     string
+		threshold, roleThreshold float32
+		hit                      bool
+	}{
+		{"default threshold", 0.9, 0, true},
+		{"role threshold over default", 0.5, 0.99, false},
+		{"role threshold under default", 0.99, 0.9, true},
+		{"disabled", 0, 0, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			b := NewGpt3p5(s, "sk-test", WithSemanticCache(s, HashEmbedder{}, time.Hour, tc.threshold))
+			role := SystemRoleVersion{SimilarityThreshold: tc.roleThreshold}
+			_, cached := b.lookupCache(ctx, role, "scope", prompt)
+			if (cached != nil) != tc.hit {
+				t.Errorf("hit is %v, want %v", cached != nil, tc.hit)
+			}
+		})
+	}
+}
+
+// TestSendCacheRedacted checks that owners sharing cached answers get their own redacted values back
+func TestSendCacheRedacted(t *testing.T) {
+	s := newTestStore(t)
+	redactor, err := NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, fake := newTestBackend(t, s, "I will write to [EMAIL_1]", WithRedactor(redactor),
+		WithResponseCache(s, time.Hour), WithSemanticCache(s, HashEmbedder{}, time.Hour, 0.9))
+	for _, tc := range []struct {
+		owner, msg string
+		cached     bool
+		answer     string
+	}{
+		{"alice", "Write a note to alice@example.com", false, "I will write to alice@example.com"},
+		// exact cache
+		{"bob", "Write a note to bob@example.com", true, "I will write to bob@example.com"},
+		// semantic cache
+		{"carol", "Please write a note to carol@example.com", true, "I will write to carol@example.com"},
+	} {
+		resp, err := b.Send(owner(tc.owner), 0, tc.msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.owner, err)
+		}
+		if resp.Cached != tc.cached || resp.Content != tc.answer {
+			t.Errorf("%s got %q cached %v, want %q cached %v", tc.owner, resp.Content, resp.Cached, tc.answer, tc.cached)
+		}
+	}
+	if prompts := fake.calls(); len(prompts) != 1 || prompts[0] != "Write a note to [EMAIL_1]" {
+		t.Errorf("OpenAI got prompts %q, want the redacted prompt of alice", prompts)
+	}
+	var leaked int64
+	for _, model := range []interface{}{&CachedResponse{}, &SemanticCacheEntry{}} {
+		var n int64
+		if err := s.db.Model(model).Where("content LIKE ?", "%@example.com%").Count(&n).Error; err != nil {
+			t.Fatal(err)
+		}
+		leaked += n
+	}
+	if leaked != 0 {
+		t.Errorf("%d cached answers hold redacted values", leaked)
+	}
+}
+
+func TestSendPromptTooLong(t *testing.T) {
+	s := newTestStore(t)
+	b, fake := newTestBackend(t, s, "answer")
+	ctx := owner("alice")
+	role := SystemRole{Name: "Assistant", Content: "Be helpful"}
+	if err := b.AddSystemRole(ctx, &role); err != nil {
+		t.Fatal(err)
+	}
+	long := strings.Repeat("hello ", 6000)
+	for _, tc := range []struct {
+		name   string
+		roleID uint
+		msg    string
+		err    error
+	}{
+		{"without system role", 0, long, ErrPromptTooLong},
+		{"with system role", role.ID, long, ErrPromptTooLong},
+		{"short message", role.ID, "hello", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c := Conversation{Name: tc.name, SystemRoleID: tc.roleID}
+			if err := b.AddConversation(ctx, &c); err != nil {
+				t.Fatal(err)
+			}
+			calls := len(fake.calls())
+			_, err := b.Send(ctx, c.ID, tc.msg)
+			if !errors.Is(err, tc.err) {
+				t.Fatalf("send returned %v, want %v", err, tc.err)
+			}
+			if called := len(fake.calls()) > calls; called != (tc.err == nil) {
+				t.Errorf("OpenAI called %v", called)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package openai
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strings"
+	"unicode"
+
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+// Embedder maps a text to a vector, texts with similar meaning get vectors with a high cosine similarity
+type Embedder interface {
+	Embed(ctx context.Context, text string) ([]float32, error)
+}
+
+// NewEmbedder returns the embedder name, "openai" or "hash", key is the OpenAI API key
+func NewEmbedder(name, key string) (Embedder, error) {
+	switch name {
+	case "openai":
+		return NewOpenAIEmbedder(key), nil
+	case "hash":
+		return HashEmbedder{}, nil
+	}
+	return nil, fmt.Errorf("unknown embedder %q", name)
+}
+
+// OpenAIEmbedder embeds texts with the text-embedding-ada-002 model
+type OpenAIEmbedder struct {
+	client *gogpt.Client
+}
+
+func NewOpenAIEmbedder(key string) *OpenAIEmbedder {
+	return &OpenAIEmbedder{client: gogpt.NewClient(key)}
+}
+
+func (e *OpenAIEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	resp, err := e.client.CreateEmbeddings(ctx, gogpt.EmbeddingRequest{
+		// OpenAI recommends replacing newlines for better results
+		Input: []string{strings.ReplaceAll(text, "\n", " ")},
+		Model: gogpt.AdaEmbeddingV2,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(resp.Data) == 0 {
+		return nil, errors.New("embedding response has no data")
+	}
+	return resp.Data[0].Embedding, nil
+}
+
+// HashEmbedder is a local embedder hashing words and word pairs into Dim buckets. It only finds
+// texts sharing most of their words, it stands in for a real model in tests and offline setups.
+type HashEmbedder struct {
+	Dim int
+}
+
+func (e HashEmbedder) Embed(ctx context.Context, text string) ([]float32, error) {
+	dim := e.Dim
+	if dim <= 0 {
+		dim = 256
+	}
+	v := make([]float32, dim)
+	words := strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+	add := func(feature string) {
+		h := fnv.New32a()
+		h.Write([]byte(feature))
+		v[h.Sum32()%uint32(dim)]++
+	}
+	for i, w := range words {
+		add(w)
+		if i > 0 {
+			add(words[i-1] + " " + w)
+		}
+	}
+	return v, nil
+}
+
+// cosine returns the cosine similarity of a and b, 0 if they differ in length or one is zero
+func cosine(a, b []float32) float32 {
+	if len(a) != len(b) {
+		return 0
+	}
+	var dot, na, nb float64
+	for i := range a {
+		dot += float64(a[i]) * float64(b[i])
+		na += float64(a[i]) * float64(a[i])
+		nb += float64(b[i]) * float64(b[i])
+	}
+	if na == 0 || nb == 0 {
+		return 0
+	}
+	return float32(dot / math.Sqrt(na*nb))
+}
+
+func encodeEmbedding(v []float32) []byte {
+	b := make([]byte, 4*len(v))
+	for i, f := range v {
+		binary.LittleEndian.PutUint32(b[4*i:], math.Float32bits(f))
+	}
+	return b
+}
+
+func decodeEmbedding(b []byte) []float32 {
+	v := make([]float32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
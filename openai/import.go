@@ -0,0 +1,203 @@
+package openai
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"gorm.io/gorm"
+)
+
+// chatGPTConversation is one entry of conversations.json in the official ChatGPT data export.
+// Messages are stored as a tree in Mapping, CurrentNode points at the leaf of the branch
+// that was displayed last.
+type chatGPTConversation struct {
+	ID             string                 `json:"id"`
+	ConversationID string                 `json:"conversation_id"`
+	Title          string                 `json:"title"`
+	CreateTime     float64                `json:"create_time"`
+	UpdateTime     float64                `json:"update_time"`
+	CurrentNode    string                 `json:"current_node"`
+	Mapping        map[string]chatGPTNode `json:"mapping"`
+}
+
+type chatGPTNode struct {
+	ID       string          `json:"id"`
+	Parent   string          `json:"parent"`
+	Children []string        `json:"children"`
+	Message  *chatGPTMessage `json:"message"`
+}
+
+type chatGPTMessage struct {
+	ID     string `json:"id"`
+	Author struct {
+		Role string `json:"role"`
+	} `json:"author"`
+	CreateTime float64 `json:"create_time"`
+	Content    struct {
+		ContentType string        `json:"content_type"`
+		Parts       []interface{} `json:"parts"`
+	} `json:"content"`
+}
+
+// ImportResult summarizes an import run
+type ImportResult struct {
+	Conversations int `json:"conversations"`
+	Messages      int `json:"messages"`
+	Skipped       int `json:"skipped"`
+}
+
+// ImportChatGPTExport reads conversations.json of a ChatGPT data export and stores every conversation
+// and its messages in store. Conversations and messages are matched by their export ids,
+// so importing the same (or a newer) export again only adds what is missing.
+func ImportChatGPTExport(ctx context.Context, store Store, r io.Reader) (ImportResult, error) {
+	var res ImportResult
+	var convs []chatGPTConversation
+	if err := json.NewDecoder(r).Decode(&convs); err != nil {
+		return res, fmt.Errorf("decode chatgpt export: %w", err)
+	}
+	for _, conv := range convs {
+		added, err := importChatGPTConversation(ctx, store, conv)
+		if err != nil {
+			return res, err
+		}
+		if added == 0 {
+			res.Skipped++
+			continue
+		}
+		res.Conversations++
+		res.Messages += added
+	}
+	return res, nil
+}
+
+func importChatGPTConversation(ctx context.Context, store Store, conv chatGPTConversation) (int, error) {
+	externalID := conv.ID
+	if externalID == "" {
+		externalID = conv.ConversationID
+	}
+	if externalID == "" {
+		return 0, fmt.Errorf("chatgpt conversation %q has no id", conv.Title)
+	}
+	externalID = "chatgpt:" + externalID
+
+	var c Conversation
+	cs, _, err := store.ListConversations(ctx, ConversationFilter{
+		ListOptions: ListOptions{Limit: 1},
+		ExternalID:  externalID,
+	})
+	if err != nil {
+		return 0, err
+	}
+	if len(cs) > 0 {
+		if c, err = store.GetConversation(ctx, cs[0].ID); err != nil {
+			return 0, err
+		}
+	} else {
+		c = Conversation{
+			Model: gorm.Model{
+				CreatedAt: exportTime(conv.CreateTime),
+				UpdatedAt: exportTime(conv.UpdateTime),
+			},
+			Name:       conv.Title,
+			ExternalID: externalID,
+		}
+		if c.Name == "" {
+			c.Name = externalID
+		}
+		if err := store.AddConversation(ctx, &c); err != nil {
+			return 0, err
+		}
+	}
+
+	seen := make(map[string]bool, len(c.Messages))
+	for _, m := range c.Messages {
+		seen[m.ExternalID] = true
+	}
+	var msgs []ChatCompletionMessage
+	for _, m := range conv.thread() {
+		content := m.text()
+		if content == "" || seen["chatgpt:"+m.ID] {
+			continue
+		}
+		created := exportTime(m.CreateTime)
+		if created.IsZero() {
+			created = c.CreatedAt
+		}
+		msgs = append(msgs, ChatCompletionMessage{
+			Model: gorm.Model{
+				CreatedAt: created,
+				UpdatedAt: created,
+			},
+			ConversationID: c.ID,
+			Role:           m.Author.Role,
+			Content:        content,
+			ExternalID:     "chatgpt:" + m.ID,
+		})
+	}
+	if len(msgs) == 0 {
+		return 0, nil
+	}
+	if err := store.AddMessages(ctx, msgs); err != nil {
+		return 0, err
+	}
+	logging.Info(ctx, "conversation imported", "conversation_id", c.ID, "external_id", externalID, "messages", len(msgs))
+	return len(msgs), nil
+}
+
+// thread returns the messages on the branch ending at CurrentNode, oldest first.
+// Edited prompts and regenerated answers live on other branches and are dropped.
+func (conv chatGPTConversation) thread() []chatGPTMessage {
+	var msgs []chatGPTMessage
+	visited := make(map[string]bool)
+	for id := conv.CurrentNode; id != "" && !visited[id]; {
+		visited[id] = true
+		node, ok := conv.Mapping[id]
+		if !ok {
+			break
+		}
+		if node.Message != nil {
+			msgs = append(msgs, *node.Message)
+		}
+		id = node.Parent
+	}
+	// Reverse msgs
+	for i := len(msgs)/2 - 1; i >= 0; i-- {
+		opp := len(msgs) - 1 - i
+		msgs[i], msgs[opp] = msgs[opp], msgs[i]
+	}
+	return msgs
+}
+
+// text returns the plain text of a user, assistant or system message. Tool calls, code
+// interpreter output and other non text parts are not importable and yield "".
+func (m chatGPTMessage) text() string {
+	switch m.Author.Role {
+	case "user", "assistant", "system":
+	default:
+		return ""
+	}
+	if m.Content.ContentType != "" && m.Content.ContentType != "text" {
+		return ""
+	}
+	parts := make([]string, 0, len(m.Content.Parts))
+	for _, p := range m.Content.Parts {
+		if s, ok := p.(string); ok && s != "" {
+			parts = append(parts, s)
+		}
+	}
+	return strings.TrimSpace(strings.Join(parts, "\n"))
+}
+
+func exportTime(ts float64) time.Time {
+	if ts <= 0 {
+		return time.Time{}
+	}
+	sec, frac := math.Modf(ts)
+	return time.Unix(int64(sec), int64(frac*1e9))
+}
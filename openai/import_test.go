@@ -0,0 +1,135 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/coolbit-in/alone/storage"
+	"github.com/coolbit-in/alone/storage/migrations"
+)
+
+// newTestStore returns a GormStore on a migrated SQLite database in a temporary directory
+func newTestStore(t *testing.T) *GormStore {
+	db, err := storage.Open(storage.Config{Driver: storage.DriverSqlite, DSN: filepath.Join(t.TempDir(), "chat.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := migrations.Up(context.Background(), db); err != nil {
+		t.Fatal(err)
+	}
+	return NewGormStore(db)
+}
+
+// chatGPTNodes builds the mapping of an exported conversation from id, parent, role and text
+// quadruples. Nodes with an empty role have a null message.
+func chatGPTNodes(nodes ...[4]string) map[string]chatGPTNode {
+	mapping := make(map[string]chatGPTNode, len(nodes))
+	for _, n := range nodes {
+		node := chatGPTNode{ID: n[0], Parent: n[1]}
+		if n[2] != "" {
+			m := &chatGPTMessage{ID: n[0], CreateTime: 1680000000}
+			m.Author.Role = n[2]
+			m.Content.ContentType = "text"
+			m.Content.Parts = []interface{}{n[3]}
+			node.Message = m
+		}
+		mapping[n[0]] = node
+	}
+	return mapping
+}
+
+// tripNodes is a conversation whose first answer was regenerated
+var tripNodes = [][4]string{
+	{"root", "", "", ""},
+	{"n1", "root", "system", ""},
+	{"n2", "n1", "user", "Plan a trip"},
+	{"n3a", "n2", "assistant", "Go to Rome"},
+	{"n3", "n2", "assistant", "Go to Paris"},
+	{"n4", "n3", "user", "Thanks"},
+}
+
+func TestChatGPTThread(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		currentNode string
+		want        []string
+	}{
+		{"current branch", "n4", []string{"n1", "n2", "n3", "n4"}},
+		{"regenerated branch", "n3a", []string{"n1", "n2", "n3a"}},
+		{"missing current node", "n9", nil},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			conv := chatGPTConversation{CurrentNode: tc.currentNode, Mapping: chatGPTNodes(tripNodes...)}
+			var ids []string
+			for _, m := range conv.thread() {
+				ids = append(ids, m.ID)
+			}
+			if !reflect.DeepEqual(ids, tc.want) {
+				t.Errorf("thread is %v, want %v", ids, tc.want)
+			}
+		})
+	}
+}
+
+func TestImportChatGPTExport(t *testing.T) {
+	store := newTestStore(t)
+	ctx := SystemContext(context.Background())
+
+	trip := chatGPTConversation{ID: "conv-1", Title: "Trip", CurrentNode: "n4", Mapping: chatGPTNodes(tripNodes...)}
+	// a newer export of the same conversation has the next answer
+	newer := trip
+	newer.CurrentNode = "n5"
+	newer.Mapping = chatGPTNodes(append(tripNodes, [4]string{"n5", "n4", "assistant", "You're welcome"})...)
+	empty := chatGPTConversation{ID: "conv-2", Title: "Empty", CurrentNode: "root", Mapping: chatGPTNodes(tripNodes[0])}
+
+	for _, tc := range []struct {
+		name   string
+		export []chatGPTConversation
+		want   ImportResult
+	}{
+		{"first import", []chatGPTConversation{trip, empty}, ImportResult{Conversations: 1, Messages: 3, Skipped: 1}},
+		{"same export", []chatGPTConversation{trip, empty}, ImportResult{Skipped: 2}},
+		{"newer export", []chatGPTConversation{newer}, ImportResult{Conversations: 1, Messages: 1}},
+	} {
+		data, err := json.Marshal(tc.export)
+		if err != nil {
+			t.Fatal(err)
+		}
+		res, err := ImportChatGPTExport(ctx, store, bytes.NewReader(data))
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if res != tc.want {
+			t.Errorf("%s imported %+v, want %+v", tc.name, res, tc.want)
+		}
+	}
+
+	cs, _, err := store.ListConversations(ctx, ConversationFilter{ExternalID: "chatgpt:conv-1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cs) != 1 {
+		t.Fatalf("%d conversations were imported from conv-1, want 1", len(cs))
+	}
+	c, err := store.GetConversation(ctx, cs[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, m := range c.Messages {
+		got = append(got, m.ExternalID+" "+m.Role+": "+m.Content)
+	}
+	want := []string{
+		"chatgpt:n2 user: Plan a trip",
+		"chatgpt:n3 assistant: Go to Paris",
+		"chatgpt:n4 user: Thanks",
+		"chatgpt:n5 assistant: You're welcome",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("imported messages are %q, want %q", got, want)
+	}
+}
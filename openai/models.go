@@ -1,12 +1,22 @@
 package openai
 
-import "gorm.io/gorm"
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
 
 type Conversation struct {
 	gorm.Model
-	Name         string                  `json:"name"`
-	SystemRoleID uint                    `json:"system_role_id,omitempty"`
-	Messages     []ChatCompletionMessage `json:"messages,omitempty"`
+	Name         string `json:"name"`
+	Owner        string `gorm:"index" json:"owner,omitempty"`
+	SystemRoleID uint   `json:"system_role_id,omitempty"`
+	// SystemRoleVersion pins the version of the system role the conversation started with
+	SystemRoleVersion int `json:"system_role_version,omitempty"`
+	// Sampling overrides the sampling defaults of the system role
+	Sampling   SamplingSettings        `gorm:"serializer:json" json:"sampling,omitempty"`
+	Messages   []ChatCompletionMessage `json:"messages,omitempty"`
+	ExternalID string                  `gorm:"index" json:"external_id,omitempty"`
 }
 
 // conversation table name conversation
@@ -21,18 +31,77 @@ type ChatCompletionMessage struct {
 	Content          string `json:"content"`
 	PromptTokens     int    `json:"prompt_tokens"`
 	CompletionTokens int    `json:"completion_tokens"`
+	ExternalID       string `gorm:"index" json:"external_id,omitempty"`
+	// ModelName, FinishReason, LatencyMs and RequestID describe the completion call of assistant messages
+	ModelName    string `gorm:"column:model" json:"model,omitempty"`
+	FinishReason string `json:"finish_reason,omitempty"`
+	LatencyMs    int64  `json:"latency_ms,omitempty"`
+	RequestID    string `json:"request_id,omitempty"`
+	// Status is MessageStatusError for both messages of a failed completion call, Error is the cause
+	Status string `gorm:"index" json:"status,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Flagged user messages were flagged by the moderation of the system role
+	Flagged           bool   `json:"flagged,omitempty"`
+	ModerationReasons string `json:"moderation_reasons,omitempty"`
+	// Cached assistant messages were answered from the response cache without a completion call
+	Cached bool `json:"cached,omitempty"`
 }
 
+const (
+	MessageStatusOK    = "ok"
+	MessageStatusError = "error"
+	// MessageStatusRejected marks user messages rejected by moderation, they were not sent
+	MessageStatusRejected = "rejected"
+)
+
 func (ChatCompletionMessage) TableName() string {
 	return "chat_completion_message"
 }
 
 type SystemRole struct {
 	gorm.Model
-	Name    string `gorm:"index" json:"name,omitempty"`
-	Content string `json:"content,omitempty"`
+	Name string `gorm:"index" json:"name,omitempty"`
+	// Content is a text/template rendered with TemplateVars when it is sent
+	Content    string           `json:"content,omitempty"`
+	Moderation ModerationPolicy `gorm:"serializer:json" json:"moderation,omitempty"`
+	// Sampling are the default sampling parameters of conversations with this role
+	Sampling SamplingSettings `gorm:"serializer:json" json:"sampling,omitempty"`
+	// SimilarityThreshold is the minimum cosine similarity of a semantic cache hit, zero uses the default threshold
+	SimilarityThreshold float32 `json:"similarity_threshold,omitempty"`
+	// Version is the current version, every change adds a SystemRoleVersion
+	Version int `gorm:"not null;default:1" json:"version,omitempty"`
 }
 
 func (SystemRole) TableName() string {
 	return "system_role"
 }
+
+// SystemRoleVersion is an immutable snapshot of a system role, it is kept when the role is deleted
+type SystemRoleVersion struct {
+	ID                  uint `gorm:"primarykey"`
+	CreatedAt           time.Time
+	SystemRoleID        uint             `gorm:"uniqueIndex:idx_system_role_version" json:"system_role_id"`
+	Version             int              `gorm:"uniqueIndex:idx_system_role_version" json:"version"`
+	Name                string           `json:"name,omitempty"`
+	Content             string           `json:"content,omitempty"`
+	Moderation          ModerationPolicy `gorm:"serializer:json" json:"moderation,omitempty"`
+	Sampling            SamplingSettings `gorm:"serializer:json" json:"sampling,omitempty"`
+	SimilarityThreshold float32          `json:"similarity_threshold,omitempty"`
+}
+
+func (SystemRoleVersion) TableName() string {
+	return "system_role_version"
+}
+
+// version returns the snapshot of the current version of sr
+func (sr SystemRole) version() SystemRoleVersion {
+	return SystemRoleVersion{
+		SystemRoleID:        sr.ID,
+		Version:             sr.Version,
+		Name:                sr.Name,
+		Content:             sr.Content,
+		Moderation:          sr.Moderation,
+		Sampling:            sr.Sampling,
+		SimilarityThreshold: sr.SimilarityThreshold,
+	}
+}
@@ -0,0 +1,155 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+const (
+	// ModerationReject refuses flagged messages, they are stored but not sent to the model
+	ModerationReject = "reject"
+	// ModerationFlag sends flagged messages and stores them with the moderation reasons
+	ModerationFlag = "flag"
+	// ModerationRewrite replaces the flagged parts before sending, it needs a provider that
+	// reports what matched, like the keywords provider. Messages that can't be rewritten are rejected
+	ModerationRewrite = "rewrite"
+)
+
+// ModerationPolicy configures the moderation of user messages of a SystemRole
+type ModerationPolicy struct {
+	// Provider is the name of the Moderator, "openai" or "keywords", empty disables moderation
+	Provider string `json:"provider,omitempty"`
+	// Action is ModerationReject, ModerationFlag or ModerationRewrite, default is ModerationReject
+	Action string `json:"action,omitempty"`
+	// Patterns are the regular expressions of the keywords provider
+	Patterns []string `json:"patterns,omitempty"`
+	// Replacement replaces matched text for ModerationRewrite, default is "***"
+	Replacement string `json:"replacement,omitempty"`
+	// Notice is the answer to rejected messages
+	Notice string `json:"notice,omitempty"`
+}
+
+// ModerationResult is the verdict of a Moderator
+type ModerationResult struct {
+	Flagged bool
+	Reasons []string
+	// Rewritten is the message with flagged parts replaced, empty if the Moderator can't rewrite
+	Rewritten string
+}
+
+// Moderator checks a user message before it is sent to the model
+type Moderator interface {
+	Moderate(ctx context.Context, policy ModerationPolicy, text string) (ModerationResult, error)
+}
+
+// PolicyError is returned by Send when a message is rejected by moderation
+type PolicyError struct {
+	Reasons []string
+	Notice  string
+}
+
+func (e *PolicyError) Error() string {
+	return "message rejected by moderation: " + strings.Join(e.Reasons, ", ")
+}
+
+// Validate checks policy against the known moderators
+func (policy ModerationPolicy) Validate(moderators map[string]Moderator) error {
+	if policy.Provider == "" {
+		return nil
+	}
+	if _, ok := moderators[policy.Provider]; !ok {
+		return fmt.Errorf("unknown moderation provider %q", policy.Provider)
+	}
+	switch policy.Action {
+	case "", ModerationReject, ModerationFlag:
+	case ModerationRewrite:
+		if policy.Provider == "openai" {
+			return fmt.Errorf("moderation provider openai can not rewrite messages")
+		}
+	default:
+		return fmt.Errorf("unknown moderation action %q", policy.Action)
+	}
+	for _, p := range policy.Patterns {
+		if _, err := regexp.Compile(p); err != nil {
+			return fmt.Errorf("moderation pattern %q: %w", p, err)
+		}
+	}
+	return nil
+}
+
+func (policy ModerationPolicy) action() string {
+	if policy.Action == "" {
+		return ModerationReject
+	}
+	return policy.Action
+}
+
+func (policy ModerationPolicy) notice() string {
+	if policy.Notice == "" {
+		return "Your message was not sent because it violates the usage policy."
+	}
+	return policy.Notice
+}
+
+// openAIModerator uses the OpenAI moderation endpoint
+type openAIModerator struct {
+	client *gogpt.Client
+}
+
+func (m openAIModerator) Moderate(ctx context.Context, policy ModerationPolicy, text string) (ModerationResult, error) {
+	var res ModerationResult
+	resp, err := m.client.Moderations(ctx, gogpt.ModerationRequest{Input: text})
+	if err != nil {
+		return res, err
+	}
+	if len(resp.Results) == 0 {
+		return res, errors.New("moderation response has no result")
+	}
+	r := resp.Results[0]
+	res.Flagged = r.Flagged
+	for _, c := range []struct {
+		reason  string
+		flagged bool
+	}{
+		{"hate", r.Categories.Hate},
+		{"hate/threatening", r.Categories.HateThreatening},
+		{"self-harm", r.Categories.SelfHarm},
+		{"sexual", r.Categories.Sexual},
+		{"sexual/minors", r.Categories.SexualMinors},
+		{"violence", r.Categories.Violence},
+		{"violence/graphic", r.Categories.ViolenceGraphic},
+	} {
+		if c.flagged {
+			res.Reasons = append(res.Reasons, c.reason)
+		}
+	}
+	return res, nil
+}
+
+// keywordModerator flags messages matching any regular expression of the policy
+type keywordModerator struct{}
+
+func (keywordModerator) Moderate(ctx context.Context, policy ModerationPolicy, text string) (ModerationResult, error) {
+	res := ModerationResult{Rewritten: text}
+	replacement := policy.Replacement
+	if replacement == "" {
+		replacement = "***"
+	}
+	for _, p := range policy.Patterns {
+		re, err := regexp.Compile(p)
+		if err != nil {
+			return res, err
+		}
+		if re.MatchString(res.Rewritten) {
+			res.Flagged = true
+			res.Reasons = append(res.Reasons, "keyword: "+p)
+			res.Rewritten = re.ReplaceAllLiteralString(res.Rewritten, replacement)
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,77 @@
+package openai
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// recordingModerator records the texts it moderates and flags them like the keywords provider
+type recordingModerator struct {
+	texts *[]string
+}
+
+func (m recordingModerator) Moderate(ctx context.Context, policy ModerationPolicy, text string) (ModerationResult, error) {
+	*m.texts = append(*m.texts, text)
+	return keywordModerator{}.Moderate(ctx, policy, text)
+}
+
+func TestModerateRedacted(t *testing.T) {
+	redactor, err := NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	const msg = "mail bob@example.com about the fight, password: hunter2"
+	for _, tc := range []struct {
+		name     string
+		redactor *Redactor
+		action   string
+		// moderated is the text the provider gets, content the message afterwards
+		moderated, content string
+	}{
+		{
+			name:      "flag without redaction",
+			action:    ModerationFlag,
+			moderated: msg,
+			content:   msg,
+		},
+		{
+			name:      "flag",
+			redactor:  redactor,
+			action:    ModerationFlag,
+			moderated: "mail [EMAIL_1] about the fight, password: [PASSWORD_1]",
+			content:   msg,
+		},
+		{
+			name:      "rewrite restores values",
+			redactor:  redactor,
+			action:    ModerationRewrite,
+			moderated: "mail [EMAIL_1] about the fight, password: [PASSWORD_1]",
+			// secrets are not restored, like in answers
+			content: "mail bob@example.com about the ***, password: [PASSWORD_1]",
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var texts []string
+			b := &Gpt3p5{moderators: map[string]Moderator{"test": recordingModerator{&texts}}}
+			var rd *redaction
+			if tc.redactor != nil {
+				rd = tc.redactor.begin()
+			}
+			policy := ModerationPolicy{Provider: "test", Action: tc.action, Patterns: []string{"fight"}}
+			m := ChatCompletionMessage{Role: "user", Content: msg}
+			if err := b.moderate(context.Background(), policy, rd, &m); err != nil {
+				t.Fatal(err)
+			}
+			if len(texts) != 1 || texts[0] != tc.moderated {
+				t.Errorf("moderated %q, want %q", texts, tc.moderated)
+			}
+			if m.Content != tc.content {
+				t.Errorf("content is %q, want %q", m.Content, tc.content)
+			}
+			if !m.Flagged || !strings.Contains(m.ModerationReasons, "fight") {
+				t.Errorf("message is not flagged: %+v", m)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package openai
+
+import (
+	"context"
+	"errors"
+)
+
+// Principal is the caller on whose behalf a Store is accessed. A Principal sees and changes only
+// the conversations, and their messages, it owns, unless it is an admin.
+type Principal struct {
+	// Owner is the value of Conversation.Owner for conversations of this caller, e.g.
+	// "synology:<user id>" for Synology Chat users
+	Owner string
+	// Admin can access the conversations of all owners
+	Admin bool
+}
+
+// SystemPrincipal is the principal of internal calls like migrations, imports, background jobs and
+// command line tools. It accesses the conversations of all owners, the conversations it adds keep
+// the owner they were given.
+var SystemPrincipal = Principal{Admin: true}
+
+// ErrNoPrincipal is returned by Store calls on owned data with a context without principal
+var ErrNoPrincipal = errors.New("no principal in context")
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p
+func WithPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// SystemContext returns a context carrying SystemPrincipal. Internal calls opt into the
+// unrestricted access with it, Store calls with a context without principal are denied.
+func SystemContext(ctx context.Context) context.Context {
+	return WithPrincipal(ctx, SystemPrincipal)
+}
+
+// PrincipalFrom returns the principal carried by ctx
+func PrincipalFrom(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// restricted returns the owner ctx is restricted to, ok is false for admins. It fails with
+// ErrNoPrincipal when ctx carries no principal.
+func restricted(ctx context.Context) (owner string, ok bool, err error) {
+	p, found := PrincipalFrom(ctx)
+	if !found {
+		return "", false, ErrNoPrincipal
+	}
+	if p.Admin {
+		return "", false, nil
+	}
+	return p.Owner, true, nil
+}
@@ -0,0 +1,183 @@
+package openai
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	gogpt "github.com/sashabaranov/go-openai"
+	"gorm.io/gorm"
+)
+
+// ErrInvalidProxyRequest is returned by Proxy for requests it can not forward
+var ErrInvalidProxyRequest = errors.New("invalid chat completion request")
+
+// proxyExternalID marks the assistant messages of proxied requests, it is followed by the digest
+// of the messages up to and including the answer
+const proxyExternalID = "openai:"
+
+// proxyDigest hashes the roles and contents of msgs. A client continuing a conversation sends
+// the earlier messages and the answer again, so the digest of its history finds the conversation.
+func proxyDigest(msgs []gogpt.ChatCompletionMessage) string {
+	h := sha256.New()
+	for _, m := range msgs {
+		fmt.Fprintf(h, "%s\x00%s\x00", m.Role, m.Content)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Proxy forwards the chat completion request of an OpenAI compatible client. Unlike Send the
+// client manages the context, its messages are sent as they are, only redaction and the
+// moderation policy of WithProxyModeration apply. The request is recorded as a conversation
+// of the principal of ctx, requests repeating the history of an earlier request continue its
+// conversation. The answer is streamed to delta unless it is nil.
+func (b *Gpt3p5) Proxy(ctx context.Context, req gogpt.ChatCompletionRequest, delta func(string) error) (resp ChatCompletionMessage, err error) {
+	if len(req.Messages) == 0 {
+		return resp, fmt.Errorf("%w: messages is empty", ErrInvalidProxyRequest)
+	}
+	if req.N > 1 {
+		return resp, fmt.Errorf("%w: n > 1 is not supported", ErrInvalidProxyRequest)
+	}
+	if req.Messages[len(req.Messages)-1].Role != gogpt.ChatMessageRoleUser {
+		return resp, fmt.Errorf("%w: the last message is not a user message", ErrInvalidProxyRequest)
+	}
+	orig := req.Messages
+	c, stored, err := b.proxyConversation(ctx, orig)
+	if err != nil {
+		return resp, err
+	}
+	newMsgs := make([]ChatCompletionMessage, 0, len(orig)-stored)
+	for _, m := range orig[stored:] {
+		newMsgs = append(newMsgs, ChatCompletionMessage{ConversationID: c.ID, Role: m.Role, Content: m.Content})
+	}
+	newMsgs[len(newMsgs)-1].Status = MessageStatusOK
+
+	var rd *redaction
+	if b.redactor != nil {
+		rd = b.redactor.begin()
+	}
+	// every message not yet recorded comes from the client, whatever its role
+	for i := range newMsgs {
+		if err := b.moderate(ctx, b.proxyModeration, rd, &newMsgs[i]); err != nil {
+			return resp, err
+		}
+	}
+	msgs := append([]gogpt.ChatCompletionMessage(nil), orig...)
+	for i, m := range newMsgs {
+		// moderation may have rewritten it
+		msgs[stored+i].Content = m.Content
+	}
+	if rd != nil {
+		for i := range msgs {
+			msgs[i].Content = rd.redact(msgs[i].Content)
+		}
+		if len(rd.counts) > 0 {
+			logging.Info(ctx, "prompt redacted", "conversation_id", c.ID, "redacted", rd.String())
+		}
+	}
+	req.Messages, req.Stream = msgs, false
+
+	callCtx, cancel := context.WithTimeout(context.WithValue(ctx, requestIDKey{}, new(string)), 60*time.Second)
+	defer cancel()
+	start := time.Now()
+	var answer completion
+	if delta == nil {
+		answer, err = b.complete(callCtx, req)
+	} else {
+		answer, err = b.completeStream(callCtx, req, rd, delta)
+	}
+	resp = ChatCompletionMessage{
+		ConversationID: c.ID,
+		Role:           gogpt.ChatMessageRoleAssistant,
+		Content:        answer.Content,
+		ModelName:      req.Model,
+		LatencyMs:      time.Since(start).Milliseconds(),
+		RequestID:      requestIDFrom(callCtx),
+		Status:         MessageStatusOK,
+	}
+	if rd != nil {
+		resp.Content = rd.restore(resp.Content)
+	}
+	if err != nil {
+		newMsgs[len(newMsgs)-1].Status, resp.Status, resp.Error = MessageStatusError, MessageStatusError, err.Error()
+		logging.Error(ctx, "proxied chat completion failed", "conversation_id", c.ID, "model", req.Model,
+			"latency_ms", resp.LatencyMs, "request_id", resp.RequestID, "error", err)
+		if serr := b.AddMessages(ctx, append(newMsgs, resp)); serr != nil {
+			logging.Error(ctx, "save failed completion", "conversation_id", c.ID, "error", serr)
+		}
+		return resp, err
+	}
+	resp.FinishReason = answer.FinishReason
+	resp.PromptTokens, resp.CompletionTokens = answer.PromptTokens, answer.CompletionTokens
+	if answer.Model != "" {
+		resp.ModelName = answer.Model
+	}
+	if resp.RequestID == "" {
+		resp.RequestID = answer.ID
+	}
+	// the digest is of what the client sent and received, not of the redacted messages
+	resp.ExternalID = proxyExternalID + proxyDigest(append(orig[:len(orig):len(orig)],
+		gogpt.ChatCompletionMessage{Role: resp.Role, Content: resp.Content}))
+	logging.Info(ctx, "proxied chat completion", "conversation_id", c.ID, "model", resp.ModelName,
+		"latency_ms", resp.LatencyMs, "request_id", resp.RequestID, "prompt_tokens", resp.PromptTokens,
+		"completion_tokens", resp.CompletionTokens, "finish_reason", resp.FinishReason, "stream", delta != nil)
+	save := append(newMsgs, resp)
+	if err := b.AddMessages(ctx, save); err != nil {
+		return resp, err
+	}
+	return save[len(save)-1], nil
+}
+
+// WithProxyModeration moderates the messages of Proxy requests with policy
+func WithProxyModeration(policy ModerationPolicy) Option {
+	return func(b *Gpt3p5) {
+		b.proxyModeration = policy
+	}
+}
+
+// ValidateModeration checks policy against the moderation providers of b
+func (b *Gpt3p5) ValidateModeration(policy ModerationPolicy) error {
+	return policy.Validate(b.moderators)
+}
+
+// proxyConversation returns the conversation whose latest answer ends the history of msgs, all
+// but the last message, and the count of messages it holds, or a new conversation holding none
+func (b *Gpt3p5) proxyConversation(ctx context.Context, msgs []gogpt.ChatCompletionMessage) (Conversation, int, error) {
+	history := msgs[:len(msgs)-1]
+	if len(history) > 0 && history[len(history)-1].Role == gogpt.ChatMessageRoleAssistant {
+		answers, _, err := b.ListMessages(ctx, MessageFilter{
+			ListOptions: ListOptions{Limit: 1, Sort: "-id"},
+			ExternalID:  proxyExternalID + proxyDigest(history),
+		})
+		if err != nil {
+			return Conversation{}, 0, err
+		}
+		if len(answers) > 0 {
+			// no need to load the messages
+			return Conversation{Model: gorm.Model{ID: answers[0].ConversationID}}, len(history), nil
+		}
+	}
+	c := Conversation{Name: proxyConversationName(msgs)}
+	err := b.AddConversation(ctx, &c)
+	return c, 0, err
+}
+
+// proxyConversationName names a new conversation after its first user message
+func proxyConversationName(msgs []gogpt.ChatCompletionMessage) string {
+	name := "chat completion"
+	for _, m := range msgs {
+		if m.Role == gogpt.ChatMessageRoleUser {
+			name = strings.Join(strings.Fields(m.Content), " ")
+			break
+		}
+	}
+	if r := []rune(name); len(r) > 64 {
+		name = string(r[:64])
+	}
+	return name
+}
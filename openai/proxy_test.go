@@ -0,0 +1,95 @@
+package openai
+
+import (
+	"errors"
+	"testing"
+
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+func TestProxyModeration(t *testing.T) {
+	redactor, err := NewRedactor(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tc := range []struct {
+		name   string
+		policy ModerationPolicy
+		msg    string
+		// prompt is what OpenAI gets, empty when the message is rejected
+		prompt    string
+		moderated string
+		status    string
+	}{
+		{
+			name:   "no policy",
+			msg:    "fight bob@example.com",
+			prompt: "fight [EMAIL_1]",
+			status: MessageStatusOK,
+		},
+		{
+			name:      "reject",
+			policy:    ModerationPolicy{Provider: "test", Patterns: []string{"fight"}},
+			msg:       "fight bob@example.com",
+			moderated: "fight [EMAIL_1]",
+			status:    MessageStatusRejected,
+		},
+		{
+			name:      "flag",
+			policy:    ModerationPolicy{Provider: "test", Action: ModerationFlag, Patterns: []string{"fight"}},
+			msg:       "fight bob@example.com",
+			prompt:    "fight [EMAIL_1]",
+			moderated: "fight [EMAIL_1]",
+			status:    MessageStatusOK,
+		},
+		{
+			name:      "rewrite",
+			policy:    ModerationPolicy{Provider: "test", Action: ModerationRewrite, Patterns: []string{"fight"}},
+			msg:       "fight bob@example.com",
+			prompt:    "*** [EMAIL_1]",
+			moderated: "fight [EMAIL_1]",
+			status:    MessageStatusOK,
+		},
+		{
+			name:      "unflagged",
+			policy:    ModerationPolicy{Provider: "test", Patterns: []string{"fight"}},
+			msg:       "hello bob@example.com",
+			prompt:    "hello [EMAIL_1]",
+			moderated: "hello [EMAIL_1]",
+			status:    MessageStatusOK,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := newTestStore(t)
+			var texts []string
+			b, fake := newTestBackend(t, s, "answer", WithRedactor(redactor),
+				WithModerator("test", recordingModerator{&texts}), WithProxyModeration(tc.policy))
+			ctx := owner("alice")
+			resp, err := b.Proxy(ctx, gogpt.ChatCompletionRequest{
+				Model:    gogpt.GPT3Dot5Turbo,
+				Messages: []gogpt.ChatCompletionMessage{{Role: gogpt.ChatMessageRoleUser, Content: tc.msg}},
+			}, nil)
+			var policyErr *PolicyError
+			if rejected := errors.As(err, &policyErr); rejected != (tc.status == MessageStatusRejected) {
+				t.Fatalf("proxy returned %v", err)
+			}
+			if tc.status != MessageStatusRejected && err != nil {
+				t.Fatal(err)
+			}
+			prompts := fake.calls()
+			if (tc.prompt == "" && len(prompts) != 0) || (tc.prompt != "" && (len(prompts) != 1 || prompts[0] != tc.prompt)) {
+				t.Errorf("OpenAI got %q, want %q", prompts, tc.prompt)
+			}
+			if (tc.moderated == "" && len(texts) != 0) || (tc.moderated != "" && (len(texts) != 1 || texts[0] != tc.moderated)) {
+				t.Errorf("moderated %q, want %q", texts, tc.moderated)
+			}
+			msgs, _, err := s.ListMessages(ctx, MessageFilter{ConversationID: resp.ConversationID, Role: gogpt.ChatMessageRoleUser})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(msgs) != 1 || msgs[0].Status != tc.status {
+				t.Fatalf("stored user messages %+v, want one of status %s", msgs, tc.status)
+			}
+		})
+	}
+}
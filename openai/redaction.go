@@ -0,0 +1,142 @@
+package openai
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// RedactionRule detects one kind of sensitive value. When Pattern has capture groups only the
+// first matching group is redacted, so "password: hunter2" keeps the "password: " part.
+type RedactionRule struct {
+	// Name is used in placeholders and logs, e.g. "email" becomes "[EMAIL_1]"
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	// Restore puts the original value back into answers, secrets are better left redacted
+	Restore bool `json:"restore"`
+}
+
+// DefaultRedactionRules detect API keys, tokens, passwords, emails, phone numbers and IPv4 addresses
+var DefaultRedactionRules = []RedactionRule{
+	{Name: "api_key", Pattern: `\b(?:sk-[A-Za-z0-9_-]{20,}|AKIA[0-9A-Z]{16}|gh[pousr]_[A-Za-z0-9]{36,}|xox[abprs]-[A-Za-z0-9-]{10,})\b`},
+	{Name: "token", Pattern: `(?i)\b(?:bearer\s+|(?:api[_-]?key|access[_-]?token|token|secret)\s*[:=]\s*["']?)([A-Za-z0-9._~+/-]{8,}=*)`},
+	{Name: "password", Pattern: `(?i)\b(?:password|passwd|pwd)\s*[:=]\s*["']?([^\s"']+)`},
+	{Name: "email", Pattern: `\b[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}\b`, Restore: true},
+	{Name: "phone", Pattern: `(?:\+\d{1,3}[ -]?)?\b\d{3,4}[ -]?\d{3,4}[ -]?\d{4}\b`, Restore: true},
+	{Name: "ip", Pattern: `\b(?:(?:25[0-5]|2[0-4]\d|1?\d?\d)\.){3}(?:25[0-5]|2[0-4]\d|1?\d?\d)\b`, Restore: true},
+}
+
+// Redactor replaces sensitive values in prompts with placeholders before they are sent to
+// the model. Stored messages keep the original values.
+type Redactor struct {
+	rules []redactionRule
+}
+
+type redactionRule struct {
+	RedactionRule
+	re *regexp.Regexp
+}
+
+// NewRedactor compiles rules, nil rules means DefaultRedactionRules
+func NewRedactor(rules []RedactionRule) (*Redactor, error) {
+	if rules == nil {
+		rules = DefaultRedactionRules
+	}
+	r := &Redactor{}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return nil, fmt.Errorf("redaction rule %q has no name", rule.Pattern)
+		}
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("redaction rule %s: %w", rule.Name, err)
+		}
+		r.rules = append(r.rules, redactionRule{RedactionRule: rule, re: re})
+	}
+	return r, nil
+}
+
+// Redact returns text with every sensitive value replaced by its placeholder, e.g. for logs
+func (r *Redactor) Redact(text string) string {
+	return r.begin().redact(text)
+}
+
+// redaction is the state of one request, the same value gets the same placeholder in every
+// message so the model can still relate them
+type redaction struct {
+	r            *Redactor
+	placeholders map[string]string // value -> placeholder
+	values       map[string]string // placeholder -> value, only for rules with Restore
+	counts       map[string]int
+}
+
+func (r *Redactor) begin() *redaction {
+	return &redaction{
+		r:            r,
+		placeholders: make(map[string]string),
+		values:       make(map[string]string),
+		counts:       make(map[string]int),
+	}
+}
+
+// redact returns text with every match of the rules replaced by its placeholder
+func (rd *redaction) redact(text string) string {
+	for _, rule := range rd.r.rules {
+		matches := rule.re.FindAllStringSubmatchIndex(text, -1)
+		if matches == nil {
+			continue
+		}
+		var b strings.Builder
+		last := 0
+		for _, m := range matches {
+			start, end := m[0], m[1]
+			for i := 2; i+1 < len(m); i += 2 {
+				if m[i] >= 0 {
+					start, end = m[i], m[i+1]
+					break
+				}
+			}
+			b.WriteString(text[last:start])
+			b.WriteString(rd.placeholder(rule, text[start:end]))
+			last = end
+		}
+		b.WriteString(text[last:])
+		text = b.String()
+	}
+	return text
+}
+
+func (rd *redaction) placeholder(rule redactionRule, value string) string {
+	if p, ok := rd.placeholders[value]; ok {
+		return p
+	}
+	rd.counts[rule.Name]++
+	p := fmt.Sprintf("[%s_%d]", strings.ToUpper(rule.Name), rd.counts[rule.Name])
+	rd.placeholders[value] = p
+	if rule.Restore {
+		rd.values[p] = value
+	}
+	return p
+}
+
+// restore puts the values of restorable placeholders back into text
+func (rd *redaction) restore(text string) string {
+	for p, v := range rd.values {
+		text = strings.ReplaceAll(text, p, v)
+	}
+	return text
+}
+
+// String summarizes the redacted values per rule without the values, e.g. "email=1, password=1"
+func (rd *redaction) String() string {
+	names := make([]string, 0, len(rd.counts))
+	for name := range rd.counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s=%d", name, rd.counts[name])
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,197 @@
+package openai
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	gogpt "github.com/sashabaranov/go-openai"
+)
+
+// ErrInvalidSampling is returned when sampling settings are out of range
+var ErrInvalidSampling = errors.New("invalid sampling settings")
+
+// SamplingSettings are the sampling parameters of completion calls. Nil fields are not set,
+// SystemRole holds the defaults and Conversation the overrides.
+type SamplingSettings struct {
+	// Model replaces the default model gpt-3.5-turbo-0301, it is not validated here, callers
+	// restrict it to the models they offer
+	Model            string   `json:"model,omitempty"`
+	Temperature      *float32 `json:"temperature,omitempty"`
+	TopP             *float32 `json:"top_p,omitempty"`
+	MaxTokens        *int     `json:"max_tokens,omitempty"`
+	PresencePenalty  *float32 `json:"presence_penalty,omitempty"`
+	FrequencyPenalty *float32 `json:"frequency_penalty,omitempty"`
+	Stop             []string `json:"stop,omitempty"`
+}
+
+// maxContextTokens is the context length of gpt-3.5-turbo, shared by prompt and answer
+const maxContextTokens = 4096
+
+// Validate checks the settings against the ranges accepted by OpenAI
+func (s SamplingSettings) Validate() error {
+	check := func(name string, v *float32, lo, hi float32) error {
+		if v != nil && (*v < lo || *v > hi) {
+			return fmt.Errorf("%w: %s must be between %g and %g", ErrInvalidSampling, name, lo, hi)
+		}
+		return nil
+	}
+	for _, err := range []error{
+		check("temperature", s.Temperature, 0, 2),
+		check("top_p", s.TopP, 0, 1),
+		check("presence_penalty", s.PresencePenalty, -2, 2),
+		check("frequency_penalty", s.FrequencyPenalty, -2, 2),
+	} {
+		if err != nil {
+			return err
+		}
+	}
+	if s.MaxTokens != nil && (*s.MaxTokens < 1 || *s.MaxTokens >= maxContextTokens) {
+		return fmt.Errorf("%w: max_tokens must be between 1 and %d", ErrInvalidSampling, maxContextTokens-1)
+	}
+	if len(s.Stop) > 4 {
+		return fmt.Errorf("%w: at most 4 stop sequences", ErrInvalidSampling)
+	}
+	return nil
+}
+
+// Merge returns s with the fields set in override replaced
+func (s SamplingSettings) Merge(override SamplingSettings) SamplingSettings {
+	if override.Model != "" {
+		s.Model = override.Model
+	}
+	if override.Temperature != nil {
+		s.Temperature = override.Temperature
+	}
+	if override.TopP != nil {
+		s.TopP = override.TopP
+	}
+	if override.MaxTokens != nil {
+		s.MaxTokens = override.MaxTokens
+	}
+	if override.PresencePenalty != nil {
+		s.PresencePenalty = override.PresencePenalty
+	}
+	if override.FrequencyPenalty != nil {
+		s.FrequencyPenalty = override.FrequencyPenalty
+	}
+	if override.Stop != nil {
+		s.Stop = override.Stop
+	}
+	return s
+}
+
+// apply sets the parameters of req
+func (s SamplingSettings) apply(req *gogpt.ChatCompletionRequest) {
+	if s.Model != "" {
+		req.Model = s.Model
+	}
+	if s.Temperature != nil {
+		req.Temperature = *s.Temperature
+		// zero is omitted from the request and OpenAI would use its default of 1
+		if req.Temperature == 0 {
+			req.Temperature = math.SmallestNonzeroFloat32
+		}
+	}
+	if s.TopP != nil {
+		req.TopP = *s.TopP
+		if req.TopP == 0 {
+			req.TopP = math.SmallestNonzeroFloat32
+		}
+	}
+	if s.MaxTokens != nil {
+		req.MaxTokens = *s.MaxTokens
+	}
+	if s.PresencePenalty != nil {
+		req.PresencePenalty = *s.PresencePenalty
+	}
+	if s.FrequencyPenalty != nil {
+		req.FrequencyPenalty = *s.FrequencyPenalty
+	}
+	req.Stop = s.Stop
+}
+
+// promptLimit returns the tokens left for the prompt when the answer may use MaxTokens
+func (s SamplingSettings) promptLimit() int {
+	limit := 4000
+	if s.MaxTokens != nil && maxContextTokens-*s.MaxTokens < limit {
+		limit = maxContextTokens - *s.MaxTokens
+	}
+	return limit
+}
+
+// Set parses value as the setting name, e.g. Set("temperature", "0.2"). An empty value unsets it,
+// stop sequences are separated by commas.
+func (s *SamplingSettings) Set(name, value string) error {
+	parseFloat := func(dst **float32) error {
+		if value == "" {
+			*dst = nil
+			return nil
+		}
+		f, err := strconv.ParseFloat(value, 32)
+		if err != nil {
+			return fmt.Errorf("%w: %s is not a number", ErrInvalidSampling, name)
+		}
+		v := float32(f)
+		*dst = &v
+		return nil
+	}
+	var err error
+	switch name {
+	case "temperature":
+		err = parseFloat(&s.Temperature)
+	case "top_p":
+		err = parseFloat(&s.TopP)
+	case "presence_penalty":
+		err = parseFloat(&s.PresencePenalty)
+	case "frequency_penalty":
+		err = parseFloat(&s.FrequencyPenalty)
+	case "max_tokens":
+		if value == "" {
+			s.MaxTokens = nil
+			break
+		}
+		n, perr := strconv.Atoi(value)
+		if perr != nil {
+			return fmt.Errorf("%w: max_tokens is not an integer", ErrInvalidSampling)
+		}
+		s.MaxTokens = &n
+	case "stop":
+		s.Stop = nil
+		if value != "" {
+			s.Stop = strings.Split(value, ",")
+		}
+	default:
+		return fmt.Errorf("%w: unknown setting %q", ErrInvalidSampling, name)
+	}
+	if err != nil {
+		return err
+	}
+	return s.Validate()
+}
+
+// String lists the set parameters, e.g. "temperature=0.2 max_tokens=500"
+func (s SamplingSettings) String() string {
+	var parts []string
+	if s.Model != "" {
+		parts = append(parts, "model="+s.Model)
+	}
+	addFloat := func(name string, v *float32) {
+		if v != nil {
+			parts = append(parts, fmt.Sprintf("%s=%g", name, *v))
+		}
+	}
+	addFloat("temperature", s.Temperature)
+	addFloat("top_p", s.TopP)
+	if s.MaxTokens != nil {
+		parts = append(parts, fmt.Sprintf("max_tokens=%d", *s.MaxTokens))
+	}
+	addFloat("presence_penalty", s.PresencePenalty)
+	addFloat("frequency_penalty", s.FrequencyPenalty)
+	if s.Stop != nil {
+		parts = append(parts, fmt.Sprintf("stop=%q", strings.Join(s.Stop, ",")))
+	}
+	return strings.Join(parts, " ")
+}
@@ -0,0 +1,179 @@
+package openai
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"gorm.io/gorm"
+)
+
+// SemanticCacheEntry is an answer of the semantic cache with the embedding of its prompt
+type SemanticCacheEntry struct {
+	ID uint `gorm:"primarykey"`
+	// Scope is the digest of everything but the prompt that shapes the answer, only entries
+	// of the same scope are compared
+	Scope     string `gorm:"index;size:64"`
+	Embedding []byte
+	Model     string
+	// Content is the answer as the model sent it, with the redaction placeholders of the prompt
+	Content      string
+	FinishReason string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time `gorm:"index"`
+	Hits         int
+}
+
+func (SemanticCacheEntry) TableName() string {
+	return "semantic_cache"
+}
+
+// SemanticCache stores answers of context-free prompts by the embedding of the prompt
+type SemanticCache interface {
+	// FindSimilarResponse returns the unexpired answer of scope whose prompt is the most similar
+	// to embedding and its cosine similarity, ok is false when scope has no answers
+	FindSimilarResponse(ctx context.Context, scope string, embedding []float32) (e SemanticCacheEntry, similarity float32, ok bool, err error)
+	// CountSimilarHit counts a hit of the answer returned by FindSimilarResponse
+	CountSimilarHit(ctx context.Context, id uint) error
+	PutSimilarResponse(ctx context.Context, e SemanticCacheEntry) error
+}
+
+var _ SemanticCache = (*GormStore)(nil)
+
+// semanticCacheScan is the count of the latest answers of a scope compared with a prompt
+const semanticCacheScan = 500
+
+// WithSemanticCache answers context-free prompts with the answer of a similar earlier prompt.
+// SystemRole.SimilarityThreshold sets the minimum cosine similarity of a hit, threshold is used
+// for roles without one and conversations without role, zero disables the semantic cache.
+func WithSemanticCache(cache SemanticCache, embedder Embedder, ttl time.Duration, threshold float32) Option {
+	return func(b *Gpt3p5) {
+		b.semantic, b.embedder, b.semanticTTL, b.threshold = cache, embedder, ttl, threshold
+	}
+}
+
+// CacheStats are the lookups of one cache kind for one system role since the start of the process
+type CacheStats struct {
+	// Kind is "exact" or "semantic"
+	Kind         string  `json:"kind"`
+	SystemRoleID uint    `json:"system_role_id"`
+	Lookups      int64   `json:"lookups"`
+	Hits         int64   `json:"hits"`
+	HitRate      float64 `json:"hit_rate"`
+	// AvgHitSimilarity and AvgMissSimilarity average the similarity of the best match of semantic
+	// lookups, a threshold between them separates hits from misses
+	AvgHitSimilarity  float64 `json:"avg_hit_similarity,omitempty"`
+	AvgMissSimilarity float64 `json:"avg_miss_similarity,omitempty"`
+}
+
+type cacheStatsKey struct {
+	kind string
+	role uint
+}
+
+type cacheStatsCounter struct {
+	lookups, hits                 int64
+	hitSimilarity, missSimilarity float64
+	similarHits, similarMisses    int64
+}
+
+// cacheStats counts cache lookups
+type cacheStats struct {
+	mu       sync.Mutex
+	counters map[cacheStatsKey]*cacheStatsCounter
+}
+
+// count records a lookup, similarity is negative for lookups without candidate
+func (s *cacheStats) count(kind string, role uint, hit bool, similarity float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counters == nil {
+		s.counters = make(map[cacheStatsKey]*cacheStatsCounter)
+	}
+	key := cacheStatsKey{kind, role}
+	c, ok := s.counters[key]
+	if !ok {
+		c = &cacheStatsCounter{}
+		s.counters[key] = c
+	}
+	c.lookups++
+	if hit {
+		c.hits++
+	}
+	if similarity < 0 {
+		return
+	}
+	if hit {
+		c.hitSimilarity += float64(similarity)
+		c.similarHits++
+	} else {
+		c.missSimilarity += float64(similarity)
+		c.similarMisses++
+	}
+}
+
+func (s *cacheStats) report() []CacheStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	res := make([]CacheStats, 0, len(s.counters))
+	for key, c := range s.counters {
+		st := CacheStats{Kind: key.kind, SystemRoleID: key.role, Lookups: c.lookups, Hits: c.hits}
+		st.HitRate = float64(c.hits) / float64(c.lookups)
+		if c.similarHits > 0 {
+			st.AvgHitSimilarity = c.hitSimilarity / float64(c.similarHits)
+		}
+		if c.similarMisses > 0 {
+			st.AvgMissSimilarity = c.missSimilarity / float64(c.similarMisses)
+		}
+		res = append(res, st)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].Kind != res[j].Kind {
+			return res[i].Kind < res[j].Kind
+		}
+		return res[i].SystemRoleID < res[j].SystemRoleID
+	})
+	return res
+}
+
+// FindSimilarResponse compares embedding with the latest answers of scope
+func (s *GormStore) FindSimilarResponse(ctx context.Context, scope string, embedding []float32) (SemanticCacheEntry, float32, bool, error) {
+	var entries []SemanticCacheEntry
+	err := s.db.WithContext(ctx).Where("scope = ? AND expires_at > ?", scope, time.Now()).
+		Order("id desc").Limit(semanticCacheScan).Find(&entries).Error
+	if err != nil {
+		logging.Error(ctx, "find similar response", "error", err)
+		return SemanticCacheEntry{}, 0, false, err
+	}
+	best, similarity := -1, float32(-1)
+	for i, e := range entries {
+		if sim := cosine(embedding, decodeEmbedding(e.Embedding)); sim > similarity {
+			best, similarity = i, sim
+		}
+	}
+	if best < 0 {
+		return SemanticCacheEntry{}, 0, false, nil
+	}
+	e := entries[best]
+	return e, similarity, true, s.open(&e.Content)
+}
+
+// CountSimilarHit counts a hit of a semantic cache answer
+func (s *GormStore) CountSimilarHit(ctx context.Context, id uint) error {
+	return s.db.WithContext(ctx).Model(&SemanticCacheEntry{}).Where("id = ?", id).
+		UpdateColumn("hits", gorm.Expr("hits + 1")).Error
+}
+
+// PutSimilarResponse stores the answer e
+func (s *GormStore) PutSimilarResponse(ctx context.Context, e SemanticCacheEntry) error {
+	if err := s.seal(&e.Content); err != nil {
+		return err
+	}
+	if err := s.db.WithContext(ctx).Create(&e).Error; err != nil {
+		logging.Error(ctx, "put similar response", "error", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,674 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/coolbit-in/alone/encryption"
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/storage"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ListOptions holds offset pagination and ordering of list queries
+type ListOptions struct {
+	Offset int
+	// Limit is the page size, zero means DefaultListLimit. It is capped to MaxListLimit
+	Limit int
+	// Sort is a column name, prefixed with "-" for descending order. Default is "id"
+	Sort string
+}
+
+const (
+	DefaultListLimit = 20
+	MaxListLimit     = 100
+)
+
+var (
+	// ErrInvalidListOptions is returned by list queries when ListOptions can not be applied
+	ErrInvalidListOptions = errors.New("invalid list options")
+	// ErrConflict is returned when a change is based on an outdated version
+	ErrConflict = errors.New("conflicting change")
+	// ErrNotFound matches the NotFoundErrors of all resources
+	ErrNotFound = errors.New("not found")
+)
+
+// NotFoundError is returned when a resource does not exist or is not owned by the principal of
+// the context. It matches ErrNotFound and gorm.ErrRecordNotFound.
+type NotFoundError struct {
+	// Resource is e.g. "conversation" or "system role"
+	Resource string
+	ID       string
+}
+
+func (e *NotFoundError) Error() string {
+	return e.Resource + " " + e.ID + " not found"
+}
+
+func (e *NotFoundError) Is(target error) bool {
+	return target == ErrNotFound || target == gorm.ErrRecordNotFound
+}
+
+// notFound turns a gorm.ErrRecordNotFound of a query of the resource id into a NotFoundError
+func notFound(err error, resource string, id interface{}) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return &NotFoundError{Resource: resource, ID: fmt.Sprint(id)}
+	}
+	return err
+}
+
+// ConversationFilter selects conversations, zero value fields are ignored
+type ConversationFilter struct {
+	ListOptions
+	// IDs selects the conversations with these ids
+	IDs           []uint
+	Owner         string
+	NameContains  string
+	SystemRoleID  uint
+	ExternalID    string
+	CreatedAfter  time.Time
+	CreatedBefore time.Time
+}
+
+// MessageFilter selects messages of a conversation, zero value fields are ignored
+type MessageFilter struct {
+	ListOptions
+	ConversationID uint
+	Role           string
+	ExternalID     string
+	// AfterID selects the messages added after the message with this id
+	AfterID uint
+}
+
+// RoleFilter selects system roles, zero value fields are ignored
+type RoleFilter struct {
+	ListOptions
+	NameContains string
+}
+
+// CompletionStats aggregates the completion calls of one model and status
+type CompletionStats struct {
+	Model  string `json:"model"`
+	Status string `json:"status"`
+	Calls  int64  `json:"calls"`
+	// Truncated counts answers cut off by the token limit, finish reason "length"
+	Truncated        int64   `json:"truncated"`
+	PromptTokens     int64   `json:"prompt_tokens"`
+	CompletionTokens int64   `json:"completion_tokens"`
+	AvgLatencyMs     float64 `json:"avg_latency_ms"`
+}
+
+// Store is the persistence of conversations, messages and system roles.
+// List methods return the requested page and the total count of matching rows.
+// Conversations and messages are restricted to the Principal of the context, calls without
+// principal fail with ErrNoPrincipal.
+type Store interface {
+	GetConversation(ctx context.Context, id uint) (Conversation, error)
+	ListConversations(ctx context.Context, f ConversationFilter) ([]Conversation, int64, error)
+	AddConversation(ctx context.Context, c *Conversation) error
+	// SetConversationSampling replaces the sampling overrides of a conversation
+	SetConversationSampling(ctx context.Context, id uint, s SamplingSettings) error
+
+	GetMessage(ctx context.Context, id uint) (ChatCompletionMessage, error)
+	ListMessages(ctx context.Context, f MessageFilter) ([]ChatCompletionMessage, int64, error)
+	AddMessages(ctx context.Context, msgs []ChatCompletionMessage) error
+	// CompletionStats reports the completion calls since the given time by model and status
+	CompletionStats(ctx context.Context, since time.Time) ([]CompletionStats, error)
+
+	GetSystemRole(ctx context.Context, id uint) (SystemRole, error)
+	ListSystemRoles(ctx context.Context, f RoleFilter) ([]SystemRole, int64, error)
+	AddSystemRole(ctx context.Context, sr *SystemRole) error
+	// UpdateSystemRole saves the settings of sr as a new version. A non-zero
+	// sr.Version must be the current version, otherwise ErrConflict is returned
+	UpdateSystemRole(ctx context.Context, sr *SystemRole) error
+	// DeleteSystemRole deletes a system role, its versions are kept for the conversations pinning them
+	DeleteSystemRole(ctx context.Context, id uint) error
+	GetSystemRoleVersion(ctx context.Context, id uint, version int) (SystemRoleVersion, error)
+	ListSystemRoleVersions(ctx context.Context, id uint, opts ListOptions) ([]SystemRoleVersion, int64, error)
+}
+
+var _ Store = (*GormStore)(nil)
+
+// GormStore implements Store on a gorm database
+type GormStore struct {
+	db      *gorm.DB
+	keyring *encryption.Keyring
+}
+
+// StoreOption configures a GormStore
+type StoreOption func(*GormStore)
+
+// WithKeyring encrypts message and system role content at rest with the keys of k
+func WithKeyring(k *encryption.Keyring) StoreOption {
+	return func(s *GormStore) {
+		s.keyring = k
+	}
+}
+
+func NewGormStore(db *gorm.DB, opts ...StoreOption) *GormStore {
+	s := &GormStore{db: db}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// ErrEncrypted is returned when encrypted content is read without a keyring
+var ErrEncrypted = errors.New("content is encrypted and no encryption key is configured")
+
+// seal encrypts a content field in place when encryption is enabled
+func (s *GormStore) seal(content *string) error {
+	if s.keyring == nil {
+		return nil
+	}
+	sealed, err := s.keyring.Encrypt(*content)
+	if err != nil {
+		return err
+	}
+	*content = sealed
+	return nil
+}
+
+// open decrypts a content field in place, plaintext content is left as it is
+func (s *GormStore) open(content *string) error {
+	if s.keyring == nil {
+		if encryption.Encrypted(*content) {
+			return ErrEncrypted
+		}
+		return nil
+	}
+	plain, err := s.keyring.Decrypt(*content)
+	if err != nil {
+		return err
+	}
+	*content = plain
+	return nil
+}
+
+func (s *GormStore) openMessages(msgs []ChatCompletionMessage) error {
+	for i := range msgs {
+		if err := s.open(&msgs[i].Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *GormStore) openSystemRoles(srs []SystemRole) error {
+	for i := range srs {
+		if err := s.open(&srs[i].Content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ownedConversations restricts q to the conversations of the principal of ctx, q fails without principal
+func (s *GormStore) ownedConversations(ctx context.Context, q *gorm.DB) *gorm.DB {
+	owner, ok, err := restricted(ctx)
+	if err != nil {
+		q.AddError(err)
+		return q
+	}
+	if ok {
+		return q.Where("owner = ?", owner)
+	}
+	return q
+}
+
+// ownedMessages restricts q to the messages of conversations of the principal of ctx, q fails
+// without principal
+func (s *GormStore) ownedMessages(ctx context.Context, q *gorm.DB) *gorm.DB {
+	owner, ok, err := restricted(ctx)
+	if err != nil {
+		q.AddError(err)
+		return q
+	}
+	if ok {
+		owned := s.db.WithContext(ctx).Model(&Conversation{}).Select("id").Where("owner = ?", owner)
+		return q.Where("conversation_id IN (?)", owned)
+	}
+	return q
+}
+
+// GetConversation returns conversation by id and it's all messages
+func (s *GormStore) GetConversation(ctx context.Context, id uint) (Conversation, error) {
+	var c Conversation
+	q := s.db.WithContext(ctx).Model(&Conversation{}).Preload("Messages")
+	err := s.ownedConversations(ctx, q).Where("id = ?", id).First(&c).Error
+	if err != nil {
+		logStoreError(ctx, "get conversation", err)
+		return c, notFound(err, "conversation", id)
+	}
+	return c, s.openMessages(c.Messages)
+}
+
+// ListConversations returns a page of conversations selected by f
+func (s *GormStore) ListConversations(ctx context.Context, f ConversationFilter) ([]Conversation, int64, error) {
+	q := s.ownedConversations(ctx, s.db.WithContext(ctx).Model(&Conversation{}))
+	if len(f.IDs) > 0 {
+		q = q.Where("id IN ?", f.IDs)
+	}
+	if f.Owner != "" {
+		q = q.Where("owner = ?", f.Owner)
+	}
+	if f.NameContains != "" {
+		q = q.Where(storage.Contains(s.db, "name"), "%"+f.NameContains+"%")
+	}
+	if f.SystemRoleID != 0 {
+		q = q.Where("system_role_id = ?", f.SystemRoleID)
+	}
+	if f.ExternalID != "" {
+		q = q.Where("external_id = ?", f.ExternalID)
+	}
+	if !f.CreatedAfter.IsZero() {
+		q = q.Where("created_at >= ?", f.CreatedAfter)
+	}
+	if !f.CreatedBefore.IsZero() {
+		q = q.Where("created_at < ?", f.CreatedBefore)
+	}
+	var cs []Conversation
+	total, err := list(q, &cs, conversationSortable, f.ListOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	return cs, total, nil
+}
+
+// AddConversation add a new conversation to db, it is owned by the principal of ctx and
+// pins the current version of its system role
+func (s *GormStore) AddConversation(ctx context.Context, c *Conversation) error {
+	p, ok := PrincipalFrom(ctx)
+	if !ok {
+		return ErrNoPrincipal
+	}
+	if c.Owner == "" || !p.Admin {
+		c.Owner = p.Owner
+	}
+	if c.SystemRoleID != 0 && c.SystemRoleVersion == 0 {
+		var sr SystemRole
+		err := s.db.WithContext(ctx).Select("id", "version").Where("id = ?", c.SystemRoleID).First(&sr).Error
+		if err != nil {
+			return notFound(err, "system role", c.SystemRoleID)
+		}
+		c.SystemRoleVersion = sr.Version
+	}
+	return s.create(ctx, c)
+}
+
+// SetConversationSampling replaces the sampling overrides of a conversation of the principal of ctx
+func (s *GormStore) SetConversationSampling(ctx context.Context, id uint, sampling SamplingSettings) error {
+	q := s.ownedConversations(ctx, s.db.WithContext(ctx).Model(&Conversation{}))
+	res := q.Where("id = ?", id).Select("Sampling").Updates(&Conversation{Sampling: sampling})
+	if res.Error != nil {
+		logStoreError(ctx, "set conversation sampling", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{Resource: "conversation", ID: fmt.Sprint(id)}
+	}
+	return nil
+}
+
+// GetMessage returns message by id
+func (s *GormStore) GetMessage(ctx context.Context, id uint) (ChatCompletionMessage, error) {
+	var m ChatCompletionMessage
+	q := s.ownedMessages(ctx, s.db.WithContext(ctx).Model(&ChatCompletionMessage{}))
+	if err := q.Where("id = ?", id).First(&m).Error; err != nil {
+		logStoreError(ctx, "get message", err)
+		return m, notFound(err, "message", id)
+	}
+	return m, s.open(&m.Content)
+}
+
+// ListMessages returns a page of messages selected by f
+func (s *GormStore) ListMessages(ctx context.Context, f MessageFilter) ([]ChatCompletionMessage, int64, error) {
+	q := s.ownedMessages(ctx, s.db.WithContext(ctx).Model(&ChatCompletionMessage{}))
+	if f.ConversationID != 0 {
+		q = q.Where("conversation_id = ?", f.ConversationID)
+	}
+	if f.Role != "" {
+		q = q.Where("role = ?", f.Role)
+	}
+	if f.ExternalID != "" {
+		q = q.Where("external_id = ?", f.ExternalID)
+	}
+	if f.AfterID != 0 {
+		q = q.Where("id > ?", f.AfterID)
+	}
+	var ms []ChatCompletionMessage
+	total, err := list(q, &ms, messageSortable, f.ListOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ms, total, s.openMessages(ms)
+}
+
+// AddMessages adds messages in one transaction, the conversations of msgs must be owned by the principal of ctx
+func (s *GormStore) AddMessages(ctx context.Context, msgs []ChatCompletionMessage) error {
+	owner, ok, err := restricted(ctx)
+	if err != nil {
+		return err
+	}
+	if ok {
+		ids := make(map[uint]bool)
+		for _, m := range msgs {
+			ids[m.ConversationID] = true
+		}
+		for id := range ids {
+			var n int64
+			err := s.db.WithContext(ctx).Model(&Conversation{}).
+				Where("id = ? AND owner = ?", id, owner).Count(&n).Error
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				return &NotFoundError{Resource: "conversation", ID: fmt.Sprint(id)}
+			}
+		}
+	}
+	// encrypt a copy, the caller keeps the plaintext
+	sealed := make([]ChatCompletionMessage, len(msgs))
+	copy(sealed, msgs)
+	for i := range sealed {
+		if err := s.seal(&sealed[i].Content); err != nil {
+			return err
+		}
+	}
+	if err := s.create(ctx, &sealed); err != nil {
+		return err
+	}
+	for i := range msgs {
+		msgs[i].Model = sealed[i].Model
+	}
+	return nil
+}
+
+// CompletionStats reports the completion calls since the given time by model and status
+func (s *GormStore) CompletionStats(ctx context.Context, since time.Time) ([]CompletionStats, error) {
+	var stats []CompletionStats
+	q := s.ownedMessages(ctx, s.db.WithContext(ctx).Model(&ChatCompletionMessage{}))
+	err := q.Select(`model, status, COUNT(*) AS calls,
+		SUM(CASE WHEN finish_reason = 'length' THEN 1 ELSE 0 END) AS truncated,
+		COALESCE(SUM(prompt_tokens), 0) AS prompt_tokens,
+		COALESCE(SUM(completion_tokens), 0) AS completion_tokens,
+		COALESCE(AVG(latency_ms), 0) AS avg_latency_ms`).
+		// imported and older messages have no status and cached answers were not sent, they
+		// were not completion calls of alone
+		Where("role = ? AND status <> ? AND cached = ? AND created_at >= ?", "assistant", "", false, since).
+		Group("model, status").Order("model, status").Scan(&stats).Error
+	if err != nil {
+		logStoreError(ctx, "completion stats", err)
+		return nil, err
+	}
+	return stats, nil
+}
+
+// GetSystemRole returns system role by id
+func (s *GormStore) GetSystemRole(ctx context.Context, id uint) (SystemRole, error) {
+	var sr SystemRole
+	if err := s.db.WithContext(ctx).Where("id = ?", id).First(&sr).Error; err != nil {
+		logStoreError(ctx, "get system role", err)
+		return sr, notFound(err, "system role", id)
+	}
+	return sr, s.open(&sr.Content)
+}
+
+// ListSystemRoles returns a page of system roles selected by f
+func (s *GormStore) ListSystemRoles(ctx context.Context, f RoleFilter) ([]SystemRole, int64, error) {
+	q := s.db.WithContext(ctx).Model(&SystemRole{})
+	if f.NameContains != "" {
+		q = q.Where(storage.Contains(s.db, "name"), "%"+f.NameContains+"%")
+	}
+	var sr []SystemRole
+	total, err := list(q, &sr, systemRoleSortable, f.ListOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+	return sr, total, s.openSystemRoles(sr)
+}
+
+// AddSystemRole adds a system role and its first version
+func (s *GormStore) AddSystemRole(ctx context.Context, sr *SystemRole) error {
+	sealed := *sr
+	sealed.Version = 1
+	if err := s.seal(&sealed.Content); err != nil {
+		return err
+	}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		if err := tx.Create(&sealed).Error; err != nil {
+			return err
+		}
+		v := sealed.version()
+		return tx.Create(&v).Error
+	})
+	if err != nil {
+		logStoreError(ctx, "add system role", err)
+		return err
+	}
+	sr.Model, sr.Version = sealed.Model, sealed.Version
+	return nil
+}
+
+// UpdateSystemRole saves the settings of sr as a new version
+func (s *GormStore) UpdateSystemRole(ctx context.Context, sr *SystemRole) error {
+	sealed := *sr
+	if err := s.seal(&sealed.Content); err != nil {
+		return err
+	}
+	err := s.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		var current SystemRole
+		if err := tx.Where("id = ?", sr.ID).First(&current).Error; err != nil {
+			return notFound(err, "system role", sr.ID)
+		}
+		if sr.Version != 0 && sr.Version != current.Version {
+			return fmt.Errorf("%w: system role %d is at version %d", ErrConflict, sr.ID, current.Version)
+		}
+		sealed.Model, sealed.Version = current.Model, current.Version+1
+		// the version condition detects concurrent updates
+		res := tx.Model(&sealed).Where("version = ?", current.Version).
+			Select("Name", "Content", "Moderation", "Sampling", "SimilarityThreshold", "Version").Updates(&sealed)
+		if res.Error != nil {
+			return res.Error
+		}
+		if res.RowsAffected == 0 {
+			return fmt.Errorf("%w: system role %d was changed concurrently", ErrConflict, sr.ID)
+		}
+		v := sealed.version()
+		return tx.Create(&v).Error
+	})
+	if err != nil {
+		logStoreError(ctx, "update system role", err)
+		return err
+	}
+	sr.Model, sr.Version = sealed.Model, sealed.Version
+	return nil
+}
+
+// DeleteSystemRole soft deletes a system role
+func (s *GormStore) DeleteSystemRole(ctx context.Context, id uint) error {
+	res := s.db.WithContext(ctx).Delete(&SystemRole{}, id)
+	if res.Error != nil {
+		logStoreError(ctx, "delete system role", res.Error)
+		return res.Error
+	}
+	if res.RowsAffected == 0 {
+		return &NotFoundError{Resource: "system role", ID: fmt.Sprint(id)}
+	}
+	return nil
+}
+
+// GetSystemRoleVersion returns a version of a system role, deleted roles included
+func (s *GormStore) GetSystemRoleVersion(ctx context.Context, id uint, version int) (SystemRoleVersion, error) {
+	var v SystemRoleVersion
+	err := s.db.WithContext(ctx).Where("system_role_id = ? AND version = ?", id, version).First(&v).Error
+	if err != nil {
+		logStoreError(ctx, "get system role version", err)
+		return v, notFound(err, "system role version", fmt.Sprintf("%d/%d", id, version))
+	}
+	return v, s.open(&v.Content)
+}
+
+// ListSystemRoleVersions returns a page of the versions of a system role
+func (s *GormStore) ListSystemRoleVersions(ctx context.Context, id uint, opts ListOptions) ([]SystemRoleVersion, int64, error) {
+	q := s.db.WithContext(ctx).Model(&SystemRoleVersion{}).Where("system_role_id = ?", id)
+	var vs []SystemRoleVersion
+	total, err := list(q, &vs, systemRoleVersionSortable, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := range vs {
+		if err := s.open(&vs[i].Content); err != nil {
+			return nil, 0, err
+		}
+	}
+	return vs, total, nil
+}
+
+// create inserts value in a transaction. Associations like the messages of a conversation are
+// skipped, they are added by their own methods, which encrypt them.
+func (s *GormStore) create(ctx context.Context, value interface{}) error {
+	tx := s.db.WithContext(ctx).Begin()
+	if err := tx.Omit(clause.Associations).Create(value).Error; err != nil {
+		tx.Rollback()
+		logStoreError(ctx, "create record", err)
+		return err
+	}
+	if err := tx.Commit().Error; err != nil {
+		tx.Rollback()
+		logStoreError(ctx, "commit record", err)
+		return err
+	}
+	return nil
+}
+
+var (
+	conversationSortable      = map[string]bool{"id": true, "name": true, "owner": true, "created_at": true, "updated_at": true, "system_role_id": true}
+	messageSortable           = map[string]bool{"id": true, "created_at": true, "role": true}
+	systemRoleSortable        = map[string]bool{"id": true, "name": true, "created_at": true, "updated_at": true}
+	systemRoleVersionSortable = map[string]bool{"id": true, "version": true, "created_at": true}
+)
+
+// list counts the rows of q and loads the requested page into dest
+func list(q *gorm.DB, dest interface{}, sortable map[string]bool, opts ListOptions) (int64, error) {
+	order, err := opts.order(sortable)
+	if err != nil {
+		return 0, err
+	}
+	// new session so that Count and Find don't share their statement
+	q = q.Session(&gorm.Session{})
+	ctx := q.Statement.Context
+	var total int64
+	if err := q.Count(&total).Error; err != nil {
+		logStoreError(ctx, "count records", err)
+		return 0, err
+	}
+	if err := q.Order(order).Offset(opts.Offset).Limit(opts.limit()).Find(dest).Error; err != nil {
+		logStoreError(ctx, "list records", err)
+		return 0, err
+	}
+	return total, nil
+}
+
+func (o ListOptions) limit() int {
+	if o.Limit <= 0 {
+		return DefaultListLimit
+	}
+	if o.Limit > MaxListLimit {
+		return MaxListLimit
+	}
+	return o.Limit
+}
+
+// order validates Sort against the sortable columns and returns the ORDER BY clause
+func (o ListOptions) order(sortable map[string]bool) (string, error) {
+	column, direction := strings.TrimPrefix(o.Sort, "-"), "asc"
+	if strings.HasPrefix(o.Sort, "-") {
+		direction = "desc"
+	}
+	if column == "" {
+		column = "id"
+	}
+	if !sortable[column] {
+		return "", fmt.Errorf("%w: can not sort by %q", ErrInvalidListOptions, column)
+	}
+	return column + " " + direction, nil
+}
+
+// Reencrypt rewrites the content of all messages, system roles and their versions, including deleted ones, and of
+// the cached answers that is plaintext or encrypted with another key than the primary key of the keyring. It is
+// run after enabling encryption or after a new primary key was added, and returns the count of rewritten rows.
+func (s *GormStore) Reencrypt(ctx context.Context) (int, error) {
+	if s.keyring == nil {
+		return 0, fmt.Errorf("no encryption key is configured")
+	}
+	type row struct {
+		ID      uint
+		Digest  string
+		Content string
+	}
+	tables := []struct {
+		model interface{}
+		// key is the primary key column, first is a value below all keys
+		key   string
+		first interface{}
+	}{
+		{&ChatCompletionMessage{}, "id", uint(0)},
+		{&SystemRole{}, "id", uint(0)},
+		{&SystemRoleVersion{}, "id", uint(0)},
+		{&SemanticCacheEntry{}, "id", uint(0)},
+		{&CachedResponse{}, "digest", ""},
+	}
+	count := 0
+	for _, t := range tables {
+		last := t.first
+		for {
+			var rows []row
+			err := s.db.WithContext(ctx).Model(t.model).Unscoped().Select(t.key, "content").
+				Where(t.key+" > ?", last).Order(t.key).Limit(100).Find(&rows).Error
+			if err != nil {
+				return count, err
+			}
+			if len(rows) == 0 {
+				break
+			}
+			for _, r := range rows {
+				last = interface{}(r.ID)
+				if t.key == "digest" {
+					last = r.Digest
+				}
+				if !s.keyring.NeedsReencrypt(r.Content) {
+					continue
+				}
+				plain, err := s.keyring.Decrypt(r.Content)
+				if err != nil {
+					return count, fmt.Errorf("row %v: %w", last, err)
+				}
+				sealed, err := s.keyring.Encrypt(plain)
+				if err != nil {
+					return count, err
+				}
+				err = s.db.WithContext(ctx).Model(t.model).Unscoped().Where(t.key+" = ?", last).
+					UpdateColumn("content", sealed).Error
+				if err != nil {
+					return count, err
+				}
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// logStoreError logs a failed store operation, missing records are expected and logged at debug level
+func logStoreError(ctx context.Context, op string, err error) {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		logging.Debug(ctx, op, "error", err)
+		return
+	}
+	logging.Error(ctx, op, "error", err)
+}
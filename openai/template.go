@@ -0,0 +1,73 @@
+package openai
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"text/template"
+	"time"
+)
+
+// TemplateVars are the variables of system role templates, e.g.
+// "You are talking to {{.Username}}, today is {{.Date}}, answer in {{.Locale}}. Team: {{.Fields.team}}"
+type TemplateVars struct {
+	Username string
+	// Now is the time of the request, Send sets it when it is zero
+	Now    time.Time
+	Locale string
+	// Fields are custom per-user values, missing fields render as empty strings
+	Fields map[string]string
+}
+
+// Date returns Now formatted as 2006-01-02
+func (v TemplateVars) Date() string {
+	return v.Now.Format("2006-01-02")
+}
+
+// Time returns Now formatted as 15:04
+func (v TemplateVars) Time() string {
+	return v.Now.Format("15:04")
+}
+
+type templateVarsKey struct{}
+
+// WithTemplateVars returns a context carrying the variables used by Send to render the system role
+func WithTemplateVars(ctx context.Context, vars TemplateVars) context.Context {
+	return context.WithValue(ctx, templateVarsKey{}, vars)
+}
+
+// TemplateVarsFrom returns the template variables carried by ctx
+func TemplateVarsFrom(ctx context.Context) (TemplateVars, bool) {
+	vars, ok := ctx.Value(templateVarsKey{}).(TemplateVars)
+	return vars, ok
+}
+
+func parseSystemRole(content string) (*template.Template, error) {
+	return template.New("system_role").Option("missingkey=zero").Parse(content)
+}
+
+// validateSystemRole parses content and renders it with sample variables, so references to
+// unknown variables are found before the role is used
+func validateSystemRole(content string) error {
+	tmpl, err := parseSystemRole(content)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(io.Discard, TemplateVars{Username: "user", Now: time.Now(), Locale: "en", Fields: map[string]string{}})
+}
+
+// RenderSystemRole renders the template content of a system role with vars
+func RenderSystemRole(content string, vars TemplateVars) (string, error) {
+	tmpl, err := parseSystemRole(content)
+	if err != nil {
+		return "", err
+	}
+	if vars.Now.IsZero() {
+		vars.Now = time.Now()
+	}
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, vars); err != nil {
+		return "", err
+	}
+	return b.String(), nil
+}
@@ -0,0 +1,40 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// HealthCheck is the row a process writes to check write access, one per host
+type HealthCheck struct {
+	Host      string `gorm:"primaryKey;size:255"`
+	CheckedAt time.Time
+}
+
+func (HealthCheck) TableName() string {
+	return "health_check"
+}
+
+// Ping checks that the database is reachable and writable by writing the HealthCheck row of
+// this host. A read-only database, a full disk or a missing grant fail the write.
+func Ping(ctx context.Context, db *gorm.DB) error {
+	sqlDB, err := db.DB()
+	if err != nil {
+		return err
+	}
+	if err := sqlDB.PingContext(ctx); err != nil {
+		return fmt.Errorf("ping: %w", err)
+	}
+	host, _ := os.Hostname()
+	row := HealthCheck{Host: host, CheckedAt: time.Now()}
+	err = db.WithContext(ctx).Clauses(clause.OnConflict{UpdateAll: true}).Create(&row).Error
+	if err != nil {
+		return fmt.Errorf("write: %w", err)
+	}
+	return nil
+}
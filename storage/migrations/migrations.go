@@ -0,0 +1,186 @@
+// Package migrations evolves the database schema in ordered, versioned steps. Applied steps are
+// recorded in the schema_migration table, so every binary sharing a database agrees on its schema.
+//
+// Steps must never change once released. They use their own snapshot structs instead of the
+// models of package openai, because the models always describe the latest schema.
+package migrations
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/coolbit-in/alone/logging"
+	"github.com/coolbit-in/alone/storage"
+	"gorm.io/gorm"
+)
+
+// Migration is one schema change
+type Migration struct {
+	Version int
+	Name    string
+	Up      func(tx *gorm.DB) error
+	Down    func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration
+type SchemaMigration struct {
+	Version   int `gorm:"primaryKey;autoIncrement:false"`
+	Name      string
+	AppliedAt time.Time
+}
+
+func (SchemaMigration) TableName() string {
+	return "schema_migration"
+}
+
+// Status is the state of a migration in a database
+type Status struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+const lockName = "alone-schema-migration"
+
+// Up applies all pending migrations in version order
+func Up(ctx context.Context, db *gorm.DB) error {
+	return storage.WithLock(ctx, db, lockName, func(tx *gorm.DB) error {
+		applied, err := appliedVersions(tx)
+		if err != nil {
+			return err
+		}
+		for _, m := range all {
+			if _, ok := applied[m.Version]; ok {
+				continue
+			}
+			logging.Info(ctx, "migrate up", "version", m.Version, "name", m.Name)
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				if err := m.Up(tx); err != nil {
+					return err
+				}
+				return tx.Create(&SchemaMigration{Version: m.Version, Name: m.Name, AppliedAt: time.Now()}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+		}
+		return nil
+	})
+}
+
+// Down reverts the latest steps applied migrations
+func Down(ctx context.Context, db *gorm.DB, steps int) error {
+	return storage.WithLock(ctx, db, lockName, func(tx *gorm.DB) error {
+		applied, err := appliedVersions(tx)
+		if err != nil {
+			return err
+		}
+		for i := len(all) - 1; i >= 0 && steps > 0; i-- {
+			m := all[i]
+			if _, ok := applied[m.Version]; !ok {
+				continue
+			}
+			logging.Info(ctx, "migrate down", "version", m.Version, "name", m.Name)
+			err := tx.Transaction(func(tx *gorm.DB) error {
+				if err := m.Down(tx); err != nil {
+					return err
+				}
+				return tx.Delete(&SchemaMigration{Version: m.Version}).Error
+			})
+			if err != nil {
+				return fmt.Errorf("migration %d %s: %w", m.Version, m.Name, err)
+			}
+			steps--
+		}
+		return nil
+	})
+}
+
+// List returns the status of every known migration in version order
+func List(ctx context.Context, db *gorm.DB) ([]Status, error) {
+	applied, err := appliedVersions(db.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Status, 0, len(all))
+	for _, m := range all {
+		sm, ok := applied[m.Version]
+		res = append(res, Status{Version: m.Version, Name: m.Name, Applied: ok, AppliedAt: sm.AppliedAt})
+	}
+	return res, nil
+}
+
+// Command runs the migrate CLI command shared by the binaries, args are
+// "status", "up" or "down [steps]" where steps defaults to 1
+func Command(ctx context.Context, db *gorm.DB, args []string, w io.Writer) error {
+	usage := fmt.Errorf("usage: migrate status|up|down [steps]")
+	if len(args) == 0 {
+		return usage
+	}
+	switch args[0] {
+	case "up":
+		if err := Up(ctx, db); err != nil {
+			return err
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			var err error
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				return usage
+			}
+		}
+		if err := Down(ctx, db, steps); err != nil {
+			return err
+		}
+	case "status":
+	default:
+		return usage
+	}
+	status, err := List(ctx, db)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+	for _, s := range status {
+		appliedAt := "pending"
+		if s.Applied {
+			appliedAt = s.AppliedAt.Format(time.RFC3339)
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+	}
+	return tw.Flush()
+}
+
+func appliedVersions(db *gorm.DB) (map[int]SchemaMigration, error) {
+	if err := db.AutoMigrate(&SchemaMigration{}); err != nil {
+		return nil, err
+	}
+	var sms []SchemaMigration
+	if err := db.Find(&sms).Error; err != nil {
+		return nil, err
+	}
+	applied := make(map[int]SchemaMigration, len(sms))
+	for _, sm := range sms {
+		applied[sm.Version] = sm
+	}
+	return applied, nil
+}
+
+func init() {
+	sort.Slice(all, func(i, j int) bool {
+		return all[i].Version < all[j].Version
+	})
+	for i := 1; i < len(all); i++ {
+		if all[i].Version == all[i-1].Version {
+			panic(fmt.Sprintf("duplicate migration version %d", all[i].Version))
+		}
+	}
+}
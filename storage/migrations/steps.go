@@ -0,0 +1,415 @@
+package migrations
+
+import (
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// all migrations, append new steps with the next version
+var all = []Migration{
+	{
+		Version: 1,
+		Name:    "initial schema",
+		// databases created before versioned migrations already have some of these tables,
+		// AutoMigrate only adds what is missing
+		Up: func(tx *gorm.DB) error {
+			return tx.AutoMigrate(&conversationV1{}, &chatCompletionMessageV1{}, &systemRoleV1{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&conversationV1{}, &chatCompletionMessageV1{}, &systemRoleV1{})
+		},
+	},
+	{
+		Version: 2,
+		Name:    "conversation owner",
+		// existing conversations have no owner, "cli migrate backfill-owners" assigns the
+		// conversations referenced by bot sessions to their Synology users
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&conversationV2{}, "Owner"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&conversationV2{}, "Owner")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropIndex(tx, &conversationV2{}, "Owner"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&conversationV2{}, "Owner")
+		},
+	},
+	{
+		Version: 3,
+		Name:    "message completion metadata",
+		Up: func(tx *gorm.DB) error {
+			for _, field := range messageV3Fields {
+				if err := tx.Migrator().AddColumn(&chatCompletionMessageV3{}, field); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&chatCompletionMessageV3{}, "Status")
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := dropIndex(tx, &chatCompletionMessageV3{}, "Status"); err != nil {
+				return err
+			}
+			for _, field := range messageV3Fields {
+				if err := tx.Migrator().DropColumn(&chatCompletionMessageV3{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 4,
+		Name:    "moderation",
+		Up: func(tx *gorm.DB) error {
+			for _, field := range []string{"Flagged", "ModerationReasons"} {
+				if err := tx.Migrator().AddColumn(&chatCompletionMessageV4{}, field); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().AddColumn(&systemRoleV4{}, "Moderation"); err != nil {
+				return err
+			}
+			// existing roles do not moderate
+			return tx.Exec("UPDATE system_role SET moderation = '{}'").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, field := range []string{"Flagged", "ModerationReasons"} {
+				if err := tx.Migrator().DropColumn(&chatCompletionMessageV4{}, field); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&systemRoleV4{}, "Moderation")
+		},
+	},
+	{
+		Version: 5,
+		Name:    "system role versions",
+		// existing roles become version 1 and conversations using them pin it
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().CreateTable(&systemRoleVersionV5{}); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&systemRoleV5{}, "Version"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().AddColumn(&conversationV5{}, "SystemRoleVersion"); err != nil {
+				return err
+			}
+			err := tx.Exec(`INSERT INTO system_role_version (created_at, system_role_id, version, name, content, moderation)
+				SELECT updated_at, id, 1, name, content, moderation FROM system_role`).Error
+			if err != nil {
+				return err
+			}
+			return tx.Exec("UPDATE conversation SET system_role_version = 1 WHERE system_role_id <> 0").Error
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropColumn(&conversationV5{}, "SystemRoleVersion"); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&systemRoleV5{}, "Version"); err != nil {
+				return err
+			}
+			return tx.Migrator().DropTable(&systemRoleVersionV5{})
+		},
+	},
+	{
+		Version: 6,
+		Name:    "sampling settings",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&conversationV6{}, &systemRoleV6{}, &systemRoleVersionV6{}} {
+				if err := tx.Migrator().AddColumn(model, "Sampling"); err != nil {
+					return err
+				}
+				// existing rows use the defaults of OpenAI
+				if err := tx.Session(&gorm.Session{AllowGlobalUpdate: true}).Model(model).Update("sampling", "{}").Error; err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&conversationV6{}, &systemRoleV6{}, &systemRoleVersionV6{}} {
+				if err := tx.Migrator().DropColumn(model, "Sampling"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 7,
+		Name:    "response cache",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&chatCompletionMessageV7{}, "Cached"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&responseCacheV7{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&responseCacheV7{}); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&chatCompletionMessageV7{}, "Cached")
+		},
+	},
+	{
+		Version: 8,
+		Name:    "semantic cache",
+		Up: func(tx *gorm.DB) error {
+			for _, model := range []interface{}{&systemRoleV8{}, &systemRoleVersionV8{}} {
+				if err := tx.Migrator().AddColumn(model, "SimilarityThreshold"); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&semanticCacheV8{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&semanticCacheV8{}); err != nil {
+				return err
+			}
+			for _, model := range []interface{}{&systemRoleV8{}, &systemRoleVersionV8{}} {
+				if err := tx.Migrator().DropColumn(model, "SimilarityThreshold"); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		Version: 9,
+		Name:    "health check",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&healthCheckV9{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&healthCheckV9{})
+		},
+	},
+	{
+		Version: 10,
+		Name:    "api keys",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&apiKeyV10{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&apiKeyV10{})
+		},
+	},
+	{
+		Version: 11,
+		Name:    "api key scopes",
+		// keys created before scopes were used for chat completions
+		Up: func(tx *gorm.DB) error {
+			for _, field := range []string{"Scopes", "RevokedAt"} {
+				if err := tx.Migrator().AddColumn(&apiKeyV11{}, field); err != nil {
+					return err
+				}
+			}
+			return tx.Exec(`UPDATE api_key SET scopes = '["read","chat"]'`).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			for _, field := range []string{"Scopes", "RevokedAt"} {
+				if err := tx.Migrator().DropColumn(&apiKeyV11{}, field); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+}
+
+// dropIndex drops the index of field unless it is gone. SQLite drops a column by copying the
+// table without the indexes of the other columns, so down steps of later versions may have
+// dropped it already.
+func dropIndex(tx *gorm.DB, model interface{}, field string) error {
+	if !tx.Migrator().HasIndex(model, field) {
+		return nil
+	}
+	return tx.Migrator().DropIndex(model, field)
+}
+
+type conversationV1 struct {
+	gorm.Model
+	Name         string
+	SystemRoleID uint
+	ExternalID   string `gorm:"index"`
+}
+
+func (conversationV1) TableName() string { return "conversation" }
+
+type chatCompletionMessageV1 struct {
+	gorm.Model
+	ConversationID   uint `gorm:"index"`
+	Role             string
+	Content          string
+	PromptTokens     int
+	CompletionTokens int
+	ExternalID       string `gorm:"index"`
+}
+
+func (chatCompletionMessageV1) TableName() string { return "chat_completion_message" }
+
+type systemRoleV1 struct {
+	gorm.Model
+	Name    string `gorm:"index"`
+	Content string
+}
+
+func (systemRoleV1) TableName() string { return "system_role" }
+
+type conversationV2 struct {
+	Owner string `gorm:"index;not null;default:''"`
+}
+
+func (conversationV2) TableName() string { return "conversation" }
+
+type chatCompletionMessageV3 struct {
+	Model        string `gorm:"not null;default:''"`
+	FinishReason string `gorm:"not null;default:''"`
+	LatencyMs    int64  `gorm:"not null;default:0"`
+	RequestID    string `gorm:"not null;default:''"`
+	Status       string `gorm:"index;not null;default:''"`
+	// errors of OpenAI are often longer than the varchar(191) MySQL gets for strings with a default
+	Error string `gorm:"type:text"`
+}
+
+func (chatCompletionMessageV3) TableName() string { return "chat_completion_message" }
+
+var messageV3Fields = []string{"Model", "FinishReason", "LatencyMs", "RequestID", "Status", "Error"}
+
+// The json and reason columns are text without default, MySQL makes strings with a default
+// varchar(191). The store always writes them.
+type chatCompletionMessageV4 struct {
+	Flagged           bool   `gorm:"not null;default:false"`
+	ModerationReasons string `gorm:"type:text"`
+}
+
+func (chatCompletionMessageV4) TableName() string { return "chat_completion_message" }
+
+type systemRoleV4 struct {
+	// json encoded openai.ModerationPolicy
+	Moderation string `gorm:"type:text"`
+}
+
+func (systemRoleV4) TableName() string { return "system_role" }
+
+type systemRoleV5 struct {
+	Version int `gorm:"not null;default:1"`
+}
+
+func (systemRoleV5) TableName() string { return "system_role" }
+
+type conversationV5 struct {
+	SystemRoleVersion int `gorm:"not null;default:0"`
+}
+
+func (conversationV5) TableName() string { return "conversation" }
+
+type systemRoleVersionV5 struct {
+	ID           uint `gorm:"primarykey"`
+	CreatedAt    time.Time
+	SystemRoleID uint `gorm:"uniqueIndex:idx_system_role_version"`
+	Version      int  `gorm:"uniqueIndex:idx_system_role_version"`
+	Name         string
+	Content      string
+	Moderation   string `gorm:"type:text"`
+}
+
+func (systemRoleVersionV5) TableName() string { return "system_role_version" }
+
+// Sampling columns hold a json encoded openai.SamplingSettings, as text without default like
+// the moderation column
+type conversationV6 struct {
+	Sampling string `gorm:"type:text"`
+}
+
+func (conversationV6) TableName() string { return "conversation" }
+
+type systemRoleV6 struct {
+	Sampling string `gorm:"type:text"`
+}
+
+func (systemRoleV6) TableName() string { return "system_role" }
+
+type systemRoleVersionV6 struct {
+	Sampling string `gorm:"type:text"`
+}
+
+func (systemRoleVersionV6) TableName() string { return "system_role_version" }
+
+type chatCompletionMessageV7 struct {
+	Cached bool `gorm:"not null;default:false"`
+}
+
+func (chatCompletionMessageV7) TableName() string { return "chat_completion_message" }
+
+type responseCacheV7 struct {
+	Digest           string `gorm:"primaryKey;size:64"`
+	Model            string
+	Content          string
+	FinishReason     string
+	PromptTokens     int
+	CompletionTokens int
+	CreatedAt        time.Time
+	ExpiresAt        time.Time `gorm:"index"`
+	Hits             int
+}
+
+func (responseCacheV7) TableName() string { return "response_cache" }
+
+type systemRoleV8 struct {
+	SimilarityThreshold float32 `gorm:"not null;default:0"`
+}
+
+func (systemRoleV8) TableName() string { return "system_role" }
+
+type systemRoleVersionV8 struct {
+	SimilarityThreshold float32 `gorm:"not null;default:0"`
+}
+
+func (systemRoleVersionV8) TableName() string { return "system_role_version" }
+
+type semanticCacheV8 struct {
+	ID           uint   `gorm:"primarykey"`
+	Scope        string `gorm:"index;size:64"`
+	Embedding    []byte
+	Model        string
+	Content      string
+	FinishReason string
+	CreatedAt    time.Time
+	ExpiresAt    time.Time `gorm:"index"`
+	Hits         int
+}
+
+func (semanticCacheV8) TableName() string { return "semantic_cache" }
+
+type healthCheckV9 struct {
+	Host      string `gorm:"primaryKey;size:255"`
+	CheckedAt time.Time
+}
+
+func (healthCheckV9) TableName() string { return "health_check" }
+
+type apiKeyV10 struct {
+	ID         uint `gorm:"primarykey"`
+	CreatedAt  time.Time
+	Name       string
+	Owner      string `gorm:"index"`
+	Prefix     string
+	Hash       string `gorm:"uniqueIndex;size:64"`
+	LastUsedAt *time.Time
+}
+
+func (apiKeyV10) TableName() string { return "api_key" }
+
+type apiKeyV11 struct {
+	// json encoded list of scopes
+	Scopes    string `gorm:"not null;default:'[]'"`
+	RevokedAt *time.Time
+}
+
+func (apiKeyV11) TableName() string { return "api_key" }
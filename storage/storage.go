@@ -0,0 +1,101 @@
+// Package storage opens the database configured for alone. SQLite, PostgreSQL and MySQL are supported,
+// engine specific SQL lives here so that the rest of the code stays portable.
+package storage
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/coolbit-in/alone/logging"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
+	"gorm.io/driver/sqlite"
+	"gorm.io/gorm"
+)
+
+const (
+	DriverSqlite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMysql    = "mysql"
+)
+
+// Config selects the database driver and its data source name
+type Config struct {
+	// Driver is one of sqlite, postgres and mysql, default is sqlite
+	Driver string `mapstructure:"driver,omitempty"`
+	// DSN is the file path for sqlite, a connection string or url for postgres and
+	// a go-sql-driver DSN for mysql. Default is chat.db for sqlite
+	DSN string `mapstructure:"dsn,omitempty"`
+}
+
+// Open connects to the database described by cfg
+func Open(cfg Config) (*gorm.DB, error) {
+	var dialector gorm.Dialector
+	switch cfg.Driver {
+	case "", DriverSqlite:
+		dsn := cfg.DSN
+		if dsn == "" {
+			dsn = "chat.db"
+		}
+		dialector = sqlite.Open(dsn)
+	case DriverPostgres:
+		dialector = postgres.Open(cfg.DSN)
+	case DriverMysql:
+		dialector = mysql.Open(cfg.DSN)
+	default:
+		return nil, fmt.Errorf("unsupported database driver %q", cfg.Driver)
+	}
+	db, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		logging.Error(context.Background(), "open database", "driver", cfg.Driver, "error", err)
+		return nil, err
+	}
+	return db, nil
+}
+
+// Contains returns a case insensitive "column contains ?" condition for the engine of db,
+// the argument has to be wrapped with "%" by the caller
+func Contains(db *gorm.DB, column string) string {
+	if db.Dialector.Name() == DriverPostgres {
+		return column + " ILIKE ?"
+	}
+	// LIKE is case insensitive for ASCII on sqlite and on mysql with the default collations
+	return column + " LIKE ?"
+}
+
+// WithLock runs fn while holding the named database wide lock, so that only one process at
+// a time runs fn against the same database. PostgreSQL uses session advisory locks, MySQL
+// uses GET_LOCK. SQLite has no named locks, fn runs in a transaction instead, which takes
+// the database write lock once fn writes.
+func WithLock(ctx context.Context, db *gorm.DB, name string, fn func(tx *gorm.DB) error) error {
+	lock, unlock := "", ""
+	var key interface{}
+	switch db.Dialector.Name() {
+	case DriverPostgres:
+		lock, unlock, key = "SELECT pg_advisory_lock(?)", "SELECT pg_advisory_unlock(?)", lockKey(name)
+	case DriverMysql:
+		lock, unlock, key = "SELECT GET_LOCK(?, -1)", "SELECT RELEASE_LOCK(?)", name
+	default:
+		return db.WithContext(ctx).Transaction(fn)
+	}
+	// session locks belong to a connection, so fn runs on the connection holding the lock
+	return db.WithContext(ctx).Connection(func(tx *gorm.DB) error {
+		if err := tx.Exec(lock, key).Error; err != nil {
+			return fmt.Errorf("acquire lock %s: %w", name, err)
+		}
+		defer func() {
+			if err := tx.WithContext(context.Background()).Exec(unlock, key).Error; err != nil {
+				logging.Error(ctx, "release lock", "lock", name, "error", err)
+			}
+		}()
+		return fn(tx)
+	})
+}
+
+// lockKey maps a lock name to a postgres advisory lock key
+func lockKey(name string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	return int64(h.Sum64())
+}
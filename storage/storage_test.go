@@ -0,0 +1,427 @@
+package storage_test
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/coolbit-in/alone/encryption"
+	"github.com/coolbit-in/alone/openai"
+	"github.com/coolbit-in/alone/storage"
+	"github.com/coolbit-in/alone/storage/migrations"
+	"gorm.io/gorm"
+)
+
+// The DSNs of throwaway databases for TestPostgres and TestMysql, the tests are skipped when
+// they are not set
+const (
+	postgresDSNEnv = "ALONE_TEST_POSTGRES_DSN"
+	mysqlDSNEnv    = "ALONE_TEST_MYSQL_DSN"
+)
+
+func TestSqlite(t *testing.T) {
+	db, err := storage.Open(storage.Config{Driver: storage.DriverSqlite, DSN: filepath.Join(t.TempDir(), "chat.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, db)
+}
+
+func TestPostgres(t *testing.T) {
+	testDriver(t, storage.DriverPostgres, postgresDSNEnv)
+}
+
+func TestMysql(t *testing.T) {
+	testDriver(t, storage.DriverMysql, mysqlDSNEnv)
+}
+
+// testDriver runs testStore on the database of driver at the DSN in the environment variable env
+func testDriver(t *testing.T, driver, env string) {
+	dsn := os.Getenv(env)
+	if dsn == "" {
+		t.Skip(env + " is not set")
+	}
+	db, err := storage.Open(storage.Config{Driver: driver, DSN: dsn})
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStore(t, db)
+}
+
+// testStore migrates db up, runs the GormStore on it and migrates it down again
+func testStore(t *testing.T, db *gorm.DB) {
+	ctx := context.Background()
+	if err := migrations.Up(ctx, db); err != nil {
+		t.Fatalf("migrate up: %v", err)
+	}
+	status, err := migrations.List(ctx, db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range status {
+		if !s.Applied {
+			t.Fatalf("migration %d %s is not applied", s.Version, s.Name)
+		}
+	}
+	t.Cleanup(func() {
+		if err := migrations.Down(ctx, db, len(status)); err != nil {
+			t.Errorf("migrate down: %v", err)
+		}
+	})
+	// migrating up again is a no-op
+	if err := migrations.Up(ctx, db); err != nil {
+		t.Fatalf("migrate up again: %v", err)
+	}
+
+	s := openai.NewGormStore(db)
+	t.Run("system roles", func(t *testing.T) { testSystemRoles(t, s) })
+	t.Run("conversations", func(t *testing.T) { testConversations(t, s) })
+	t.Run("ownership", func(t *testing.T) { testOwnership(t, s) })
+	t.Run("lock", func(t *testing.T) { testLock(t, db) })
+	t.Run("key rotation", func(t *testing.T) { testKeyRotation(t, db) })
+}
+
+func testSystemRoles(t *testing.T, s *openai.GormStore) {
+	ctx := context.Background()
+	// the json of the policy does not fit into a varchar(191)
+	moderation := openai.ModerationPolicy{
+		Provider: "keywords",
+		Patterns: []string{`(?i)\bpassword\b`, `(?i)\bcredit card\b`, `(?i)\bsocial security number\b`},
+		Notice:   "Sorry, I can not help with passwords, credit cards or social security numbers. Please ask something else.",
+	}
+	sr := openai.SystemRole{Name: "Translator", Content: "Translate to English", Moderation: moderation}
+	if err := s.AddSystemRole(ctx, &sr); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetSystemRole(ctx, sr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Content != "Translate to English" || got.Version != 1 || !reflect.DeepEqual(got.Moderation, moderation) {
+		t.Fatalf("role has %q at version %d and moderation %+v", got.Content, got.Version, got.Moderation)
+	}
+	update := got
+	update.Content = "Translate to German"
+	if err := s.UpdateSystemRole(ctx, &update); err != nil {
+		t.Fatal(err)
+	}
+	// got is at the outdated version 1
+	got.Content = "Translate to French"
+	if err := s.UpdateSystemRole(ctx, &got); !errors.Is(err, openai.ErrConflict) {
+		t.Fatalf("outdated update returned %v, want ErrConflict", err)
+	}
+	got, err = s.GetSystemRole(ctx, sr.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Version != 2 || got.Content != "Translate to German" {
+		t.Fatalf("role is at version %d with %q", got.Version, got.Content)
+	}
+	v1, err := s.GetSystemRoleVersion(ctx, sr.ID, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v1.Content != "Translate to English" || !reflect.DeepEqual(v1.Moderation, moderation) {
+		t.Fatalf("version 1 has %q and moderation %+v", v1.Content, v1.Moderation)
+	}
+	roles, total, err := s.ListSystemRoles(ctx, openai.RoleFilter{NameContains: "translat"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(roles) != 1 {
+		t.Fatalf("listed %d of %d roles, want 1", len(roles), total)
+	}
+	if err := s.DeleteSystemRole(ctx, sr.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSystemRole(ctx, sr.ID); !errors.Is(err, openai.ErrNotFound) {
+		t.Fatalf("get deleted role returned %v, want ErrNotFound", err)
+	}
+	// conversations pinning a version of a deleted role still find it
+	if _, err := s.GetSystemRoleVersion(ctx, sr.ID, 2); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testConversations(t *testing.T, s *openai.GormStore) {
+	ctx := openai.WithPrincipal(context.Background(), openai.Principal{Owner: "crud"})
+	sr := openai.SystemRole{Name: "Assistant", Content: "Be helpful"}
+	if err := s.AddSystemRole(ctx, &sr); err != nil {
+		t.Fatal(err)
+	}
+	c := openai.Conversation{Name: "Hello", SystemRoleID: sr.ID}
+	if err := s.AddConversation(ctx, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Owner != "crud" || c.SystemRoleVersion != 1 {
+		t.Fatalf("added conversation has owner %q and role version %d", c.Owner, c.SystemRoleVersion)
+	}
+	// errors of OpenAI do not fit into a varchar(191)
+	longError := strings.Repeat("upstream error ", 20)
+	msgs := []openai.ChatCompletionMessage{
+		{ConversationID: c.ID, Role: "user", Content: "Hi", Status: openai.MessageStatusOK,
+			Flagged: true, ModerationReasons: strings.Repeat("harassment, ", 20)},
+		{ConversationID: c.ID, Role: "assistant", Content: "Hello!", Status: openai.MessageStatusOK,
+			ModelName: "gpt-3.5-turbo", FinishReason: "stop", PromptTokens: 10, CompletionTokens: 2},
+		{ConversationID: c.ID, Role: "assistant", Status: openai.MessageStatusError, Error: longError},
+	}
+	if err := s.AddMessages(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	got, err := s.GetConversation(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 3 || got.Messages[1].Content != "Hello!" || got.Messages[2].Error != longError ||
+		got.Messages[0].ModerationReasons != msgs[0].ModerationReasons {
+		t.Fatalf("conversation has messages %+v", got.Messages)
+	}
+	page, total, err := s.ListMessages(ctx, openai.MessageFilter{
+		ConversationID: c.ID,
+		Role:           "assistant",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 2 || len(page) != 2 || page[0].ID != msgs[1].ID {
+		t.Fatalf("listed %d of %d assistant messages, want 2", len(page), total)
+	}
+	after, _, err := s.ListMessages(ctx, openai.MessageFilter{ConversationID: c.ID, AfterID: msgs[0].ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != 2 || after[0].ID != msgs[1].ID {
+		t.Fatalf("listed %d messages after %d, want 2", len(after), msgs[0].ID)
+	}
+	// the json of the settings does not fit into a varchar(191)
+	temperature := float32(0.2)
+	sampling := openai.SamplingSettings{
+		Temperature: &temperature,
+		Stop:        []string{"\nUser:", "\nAssistant:", "\nSystem:", "<|endoftext|>", strings.Repeat("-", 150)},
+	}
+	if err := s.SetConversationSampling(ctx, c.ID, sampling); err != nil {
+		t.Fatal(err)
+	}
+	if got, err = s.GetConversation(ctx, c.ID); err != nil || !reflect.DeepEqual(got.Sampling, sampling) {
+		t.Fatalf("conversation has sampling %+v: %v", got.Sampling, err)
+	}
+	if _, _, err := s.ListConversations(ctx, openai.ConversationFilter{
+		ListOptions: openai.ListOptions{Sort: "content"},
+	}); !errors.Is(err, openai.ErrInvalidListOptions) {
+		t.Fatalf("sort by unknown column returned %v, want ErrInvalidListOptions", err)
+	}
+	cs, total, err := s.ListConversations(ctx, openai.ConversationFilter{
+		ListOptions:  openai.ListOptions{Sort: "-created_at"},
+		NameContains: "hell",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if total != 1 || len(cs) != 1 || cs[0].ID != c.ID {
+		t.Fatalf("listed %d of %d conversations, want 1", len(cs), total)
+	}
+	stats, err := s.CompletionStats(ctx, c.CreatedAt.Add(-1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stats) != 2 || stats[1].Calls != 1 || stats[1].CompletionTokens != 2 {
+		t.Fatalf("completion stats %+v", stats)
+	}
+}
+
+func testOwnership(t *testing.T, s *openai.GormStore) {
+	alice := openai.WithPrincipal(context.Background(), openai.Principal{Owner: "alice"})
+	bob := openai.WithPrincipal(context.Background(), openai.Principal{Owner: "bob"})
+	admin := openai.WithPrincipal(context.Background(), openai.Principal{Owner: "admin", Admin: true})
+
+	c := openai.Conversation{Name: "private", Owner: "bob"}
+	if err := s.AddConversation(alice, &c); err != nil {
+		t.Fatal(err)
+	}
+	if c.Owner != "alice" {
+		t.Fatalf("conversation of alice is owned by %q", c.Owner)
+	}
+	msg := []openai.ChatCompletionMessage{{ConversationID: c.ID, Role: "user", Content: "secret"}}
+	if err := s.AddMessages(alice, msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := s.GetConversation(bob, c.ID); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob got the conversation of alice: %v", err)
+	}
+	if _, err := s.GetMessage(bob, msg[0].ID); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob got the message of alice: %v", err)
+	}
+	if err := s.AddMessages(bob, []openai.ChatCompletionMessage{{ConversationID: c.ID, Role: "user", Content: "hi"}}); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob added a message to the conversation of alice: %v", err)
+	}
+	if err := s.SetConversationSampling(bob, c.ID, openai.SamplingSettings{}); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob changed the conversation of alice: %v", err)
+	}
+	key := openai.APIKey{Name: "laptop", Owner: "alice", Scopes: []string{openai.ScopeRead}}
+	if _, err := s.CreateAPIKey(alice, &key); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.GetAPIKey(alice, key.ID); err != nil || got.Name != "laptop" {
+		t.Errorf("alice got api key %q: %v", got.Name, err)
+	}
+	if _, err := s.GetAPIKey(bob, key.ID); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob got the api key of alice: %v", err)
+	}
+	if err := s.RevokeAPIKey(bob, key.ID); !errors.Is(err, openai.ErrNotFound) {
+		t.Errorf("bob revoked the api key of alice: %v", err)
+	}
+	if _, total, err := s.ListConversations(bob, openai.ConversationFilter{}); err != nil || total != 0 {
+		t.Errorf("bob listed %d conversations: %v", total, err)
+	}
+	if _, total, err := s.ListMessages(bob, openai.MessageFilter{ConversationID: c.ID}); err != nil || total != 0 {
+		t.Errorf("bob listed %d messages of alice: %v", total, err)
+	}
+
+	if _, err := s.GetConversation(admin, c.ID); err != nil {
+		t.Errorf("admin can not get the conversation of alice: %v", err)
+	}
+	other := openai.Conversation{Name: "for bob", Owner: "bob"}
+	if err := s.AddConversation(admin, &other); err != nil {
+		t.Fatal(err)
+	}
+	if other.Owner != "bob" {
+		t.Errorf("admin added a conversation for bob owned by %q", other.Owner)
+	}
+	if _, total, err := s.ListConversations(admin, openai.ConversationFilter{Owner: "bob"}); err != nil || total != 1 {
+		t.Errorf("admin listed %d conversations of bob: %v", total, err)
+	}
+
+	// calls without principal are denied, internal calls opt into the system principal
+	none := context.Background()
+	if _, err := s.GetConversation(none, c.ID); !errors.Is(err, openai.ErrNoPrincipal) {
+		t.Errorf("get conversation without principal returned %v, want ErrNoPrincipal", err)
+	}
+	if _, _, err := s.ListMessages(none, openai.MessageFilter{}); !errors.Is(err, openai.ErrNoPrincipal) {
+		t.Errorf("list messages without principal returned %v, want ErrNoPrincipal", err)
+	}
+	if err := s.AddMessages(none, msg); !errors.Is(err, openai.ErrNoPrincipal) {
+		t.Errorf("add messages without principal returned %v, want ErrNoPrincipal", err)
+	}
+	if err := s.AddConversation(none, &openai.Conversation{Name: "nobody"}); !errors.Is(err, openai.ErrNoPrincipal) {
+		t.Errorf("add conversation without principal returned %v, want ErrNoPrincipal", err)
+	}
+	if _, _, err := s.ListAPIKeys(none, openai.APIKeyFilter{}); !errors.Is(err, openai.ErrNoPrincipal) {
+		t.Errorf("list api keys without principal returned %v, want ErrNoPrincipal", err)
+	}
+	system := openai.SystemContext(context.Background())
+	if _, err := s.GetConversation(system, c.ID); err != nil {
+		t.Errorf("system can not get the conversation of alice: %v", err)
+	}
+	unowned := openai.Conversation{Name: "imported"}
+	if err := s.AddConversation(system, &unowned); err != nil {
+		t.Fatal(err)
+	}
+	if unowned.Owner != "" {
+		t.Errorf("system added a conversation owned by %q", unowned.Owner)
+	}
+}
+
+func testLock(t *testing.T, db *gorm.DB) {
+	ctx := context.Background()
+	ran := false
+	err := storage.WithLock(ctx, db, "test", func(tx *gorm.DB) error {
+		ran = true
+		return tx.Create(&openai.Conversation{Name: "locked"}).Error
+	})
+	if err != nil || !ran {
+		t.Fatalf("locked function ran %v: %v", ran, err)
+	}
+	// the lock is released, so it can be taken again
+	want := errors.New("failed")
+	if err := storage.WithLock(ctx, db, "test", func(*gorm.DB) error { return want }); !errors.Is(err, want) {
+		t.Fatalf("second lock returned %v, want the error of the function", err)
+	}
+}
+
+// keyring returns a keyring of new keys with the given ids, the first is the primary key
+func keyring(t *testing.T, lines ...string) *encryption.Keyring {
+	k, err := encryption.ParseKeyring(strings.NewReader(strings.Join(lines, "\n")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func keyLine(t *testing.T, id string) string {
+	line, err := encryption.GenerateKey(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return line
+}
+
+func testKeyRotation(t *testing.T, db *gorm.DB) {
+	ctx := openai.WithPrincipal(context.Background(), openai.Principal{Owner: "rotation"})
+	oldKey, newKey := keyLine(t, "old"), keyLine(t, "new")
+	s := openai.NewGormStore(db, openai.WithKeyring(keyring(t, oldKey)))
+
+	c := openai.Conversation{
+		Name: "rotated",
+		// messages are added with AddMessages, which encrypts them
+		Messages: []openai.ChatCompletionMessage{{Role: "user", Content: "not stored"}},
+	}
+	if err := s.AddConversation(ctx, &c); err != nil {
+		t.Fatal(err)
+	}
+	msgs := []openai.ChatCompletionMessage{{ConversationID: c.ID, Role: "user", Content: "sealed"}}
+	if err := s.AddMessages(ctx, msgs); err != nil {
+		t.Fatal(err)
+	}
+	sr := openai.SystemRole{Name: "Rotated", Content: "sealed role"}
+	if err := s.AddSystemRole(ctx, &sr); err != nil {
+		t.Fatal(err)
+	}
+	expires := time.Now().Add(time.Hour)
+	if err := s.PutCachedResponse(ctx, openai.CachedResponse{Digest: "rotation", Content: "cached", ExpiresAt: expires}); err != nil {
+		t.Fatal(err)
+	}
+	embedding := []float32{1, 0}
+	// the little endian float32 encoding of embedding
+	err := s.PutSimilarResponse(ctx, openai.SemanticCacheEntry{Scope: "rotation", Embedding: []byte{0, 0, 128, 63, 0, 0, 0, 0},
+		Content: "similar", ExpiresAt: expires})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rotating := openai.NewGormStore(db, openai.WithKeyring(keyring(t, newKey, oldKey)))
+	if _, err := rotating.Reencrypt(ctx); err != nil {
+		t.Fatal(err)
+	}
+	// the old key is removed after the rotation
+	s = openai.NewGormStore(db, openai.WithKeyring(keyring(t, newKey)))
+	got, err := s.GetConversation(ctx, c.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.Messages) != 1 || got.Messages[0].Content != "sealed" {
+		t.Errorf("conversation has messages %+v, want the sealed message only", got.Messages)
+	}
+	role, err := s.GetSystemRole(ctx, sr.ID)
+	if err != nil || role.Content != "sealed role" {
+		t.Errorf("system role has %q: %v", role.Content, err)
+	}
+	cached, ok, err := s.GetCachedResponse(ctx, "rotation")
+	if err != nil || !ok || cached.Content != "cached" {
+		t.Errorf("cached response %q, %v: %v", cached.Content, ok, err)
+	}
+	similar, _, ok, err := s.FindSimilarResponse(ctx, "rotation", embedding)
+	if err != nil || !ok || similar.Content != "similar" {
+		t.Errorf("similar response %q, %v: %v", similar.Content, ok, err)
+	}
+	var plain int64
+	err = db.Model(&openai.ChatCompletionMessage{}).Where("content <> '' AND content NOT LIKE ?", "enc:v1:new:%").Count(&plain).Error
+	if err != nil || plain != 0 {
+		t.Errorf("%d messages are not encrypted with the new key: %v", plain, err)
+	}
+}